@@ -17,7 +17,11 @@
 package config
 
 import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
@@ -30,6 +34,107 @@ type Config struct {
 	RouteDriver        string
 	ForwardNodeIP      bool
 	MetricsBindAddress string
+	// MetricsAuthMode is the authentication of the metrics endpoint, one of none, token and mtls.
+	MetricsAuthMode string
+	// MetricsAuthenticated is true if the metrics endpoint is served with authentication by MetricsAuthMode.
+	// The handlers changing the agent at runtime are only served with authentication.
+	MetricsAuthenticated bool
+	// MetricsTokenFile is the file of the bearer token required by the token mode.
+	MetricsTokenFile string
+	// MetricsTLSCertFile and MetricsTLSKeyFile are the serving certificate of the metrics endpoint,
+	// it is served over plain HTTP if they are empty. They are required by the mtls mode.
+	MetricsTLSCertFile string
+	MetricsTLSKeyFile  string
+	// MetricsClientCAFile is the CA bundle verifying the client certificates in the mtls mode.
+	MetricsClientCAFile string
+	// HealthProbeBindAddress is the binding address of /healthz and /readyz, empty disables them.
+	HealthProbeBindAddress string
+	// PublicIPAPIs is the list of APIs used to detect the public IP of gateway node.
+	// The default APIs are used if it is empty.
+	PublicIPAPIs []string
+	// PublicIPOverride is the public IP of the node used instead of detecting it by PublicIPAPIs.
+	PublicIPOverride string
+	// PublicIPCacheTTL is how long a detected public IP is reused before detecting again.
+	PublicIPCacheTTL time.Duration
+	// PublicIPRefreshInterval is the interval to detect public IP of the local active endpoint again.
+	// Zero means never refresh once detected.
+	PublicIPRefreshInterval time.Duration
+	// WireGuardKeepAliveInterval is the persistent keepalive interval of WireGuard peers, 0 disables it.
+	WireGuardKeepAliveInterval time.Duration
+	// WireGuardMTU is the MTU of the WireGuard device, 0 means computing it from the default route link.
+	WireGuardMTU int
+	// IPSecIKEVersion is the IKE version used by libreswan connections, 0 means the libreswan default.
+	IPSecIKEVersion int
+	// IPSecIKEProposals are the IKE proposals used by libreswan connections, the libreswan defaults are used if empty.
+	IPSecIKEProposals []string
+	// IPSecESPProposals are the ESP proposals used by libreswan connections, the libreswan defaults are used if empty.
+	IPSecESPProposals []string
+	// IPSecDPDDelay is the dead peer detection interval of libreswan connections, 0 disables dead peer detection.
+	IPSecDPDDelay time.Duration
+	// IPSecDPDTimeout is how long a libreswan peer is unresponsive before it is declared dead.
+	IPSecDPDTimeout time.Duration
+	// IPSecDPDAction is the action when a libreswan peer is declared dead, one of clear, hold and restart.
+	IPSecDPDAction string
+	// IPSecFailureThreshold is how many times in a row a libreswan connection fails before it is not retried
+	// for IPSecFailureCooldown, 0 disables it.
+	IPSecFailureThreshold int
+	IPSecFailureCooldown  time.Duration
+	// IPSecMode is the IPSec mode of libreswan connections, tunnel or transport. Transport mode saves the inner
+	// IP header, but only applies to host-to-host subnets, the other connections are not made.
+	IPSecMode string
+	// RouteProtocol is the protocol (rtproto) of routes added by raven, 0 means the default.
+	RouteProtocol int
+	// MSSClamp indicates clamping the TCP MSS of traffic sent to remote subnets to fit the tunnel MTU.
+	MSSClamp bool
+	// RelaySelector selects the gateways preferred as the central gateway relaying traffic between NATed gateways.
+	// It must be the same on all agents, so that they choose the same central gateway.
+	RelaySelector string
+	// ExcludeCIDRs are the destinations that never go through the tunnel, e.g. the cloud metadata IP.
+	ExcludeCIDRs []string
+	// StartupJitter is the max random delay before the engine controller starts, 0 disables it.
+	StartupJitter time.Duration
+	// TracingEndpoint is the OTLP gRPC endpoint the spans of syncs are exported to, empty disables tracing.
+	TracingEndpoint string
+	// TracingInsecure disables TLS of the connection to TracingEndpoint.
+	TracingInsecure bool
+	// LinkStatsInterval is the interval to sample the statistics of the links managed by the drivers, 0 disables it.
+	LinkStatsInterval time.Duration
+	// HeartbeatPort is the UDP port of the heartbeats between gateways, 0 disables heartbeats.
+	// It must be the same on all agents.
+	HeartbeatPort int
+	// HeartbeatInterval is the interval to send heartbeats to the remote gateways.
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout is how long a remote gateway does not answer heartbeats before it is unhealthy.
+	HeartbeatTimeout time.Duration
+	// SyncTimeout bounds a sync, 0 disables it. The driver calls take no context, so a timed out driver call is
+	// abandoned and the drivers are not called again until it returns, see SyncStuckTimeout.
+	SyncTimeout time.Duration
+	// SyncStuckTimeout is how long a sync or a driver call may run before /healthz fails, 0 disables it.
+	SyncStuckTimeout time.Duration
+	// ResyncPeriod is the interval to apply the network to the drivers even without Gateway events, 0 disables it.
+	ResyncPeriod time.Duration
+	// SyncRetryBaseDelay and SyncRetryMaxDelay bound the exponential backoff of retrying a failed sync.
+	SyncRetryBaseDelay time.Duration
+	SyncRetryMaxDelay  time.Duration
+	// SyncMaxRetries is how many times a failed sync is retried before the event is dropped.
+	SyncMaxRetries int
+	// GatewayUpdateRetry is the backoff of retrying conflicting Gateway updates, see GatewayUpdateBackoff.
+	GatewayUpdateRetry wait.Backoff
+	// PreserveOnExit indicates skipping the cleanup of drivers on graceful shutdown, so that the routes, ip sets
+	// and iptables rules of the route driver and the WireGuard device with its key and peers are kept and adopted
+	// on the next start. The libreswan connections are re-established by the next agent.
+	PreserveOnExit bool
+	// DryRun indicates only logging the desired network instead of applying it with the drivers.
+	DryRun bool
+}
+
+// GatewayUpdateBackoff returns the backoff of retrying conflicting Gateway updates,
+// retry.DefaultBackoff if GatewayUpdateRetry is not set.
+func (c *Config) GatewayUpdateBackoff() wait.Backoff {
+	if c.GatewayUpdateRetry.Steps <= 0 {
+		return retry.DefaultBackoff
+	}
+	return c.GatewayUpdateRetry
 }
 
 type completedConfig struct {
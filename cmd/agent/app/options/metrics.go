@@ -0,0 +1,234 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/openyurtio/raven/cmd/agent/app/config"
+)
+
+const (
+	// MetricsAuthNone serves the metrics endpoint without authentication, it is the default.
+	MetricsAuthNone = "none"
+	// MetricsAuthToken requires the bearer token in --metrics-token-file.
+	MetricsAuthToken = "token"
+	// MetricsAuthMTLS requires a client certificate signed by --metrics-client-ca-file.
+	MetricsAuthMTLS = "mtls"
+
+	metricsPath = "/metrics"
+)
+
+// validateMetricsAuth validates the authentication options of the metrics endpoint.
+func (o *AgentOptions) validateMetricsAuth() error {
+	switch o.MetricsAuthMode {
+	case MetricsAuthNone:
+		return nil
+	case MetricsAuthToken:
+		if o.MetricsTokenFile == "" {
+			return errors.New("--metrics-token-file is required")
+		}
+	case MetricsAuthMTLS:
+		if o.MetricsClientCAFile == "" {
+			return errors.New("--metrics-client-ca-file is required")
+		}
+		if o.MetricsTLSCertFile == "" {
+			return errors.New("--metrics-tls-cert-file and --metrics-tls-key-file are required")
+		}
+	default:
+		return fmt.Errorf("unsupported mode %q, must be one of %s, %s and %s", o.MetricsAuthMode, MetricsAuthNone, MetricsAuthToken, MetricsAuthMTLS)
+	}
+	if (o.MetricsTLSCertFile == "") != (o.MetricsTLSKeyFile == "") {
+		return errors.New("--metrics-tls-cert-file and --metrics-tls-key-file must be set together")
+	}
+	return nil
+}
+
+// metricsServer serves the metrics endpoint and the extra handlers behind authentication, instead of the
+// metrics server of the manager, which can not be wrapped by a middleware.
+type metricsServer struct {
+	addr      string
+	tlsConfig *tls.Config
+	auth      func(http.Handler) http.Handler
+
+	mutex    sync.Mutex
+	started  bool
+	handlers map[string]http.Handler
+}
+
+func newMetricsServer(c *config.Config) (*metricsServer, error) {
+	s := &metricsServer{
+		addr:     c.MetricsBindAddress,
+		handlers: make(map[string]http.Handler),
+	}
+	if s.addr == "" {
+		s.addr = metrics.DefaultBindAddress
+	}
+	if c.MetricsTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.MetricsTLSCertFile, c.MetricsTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading metrics serving certificate: %s", err)
+		}
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	switch c.MetricsAuthMode {
+	case MetricsAuthToken:
+		token, err := os.ReadFile(c.MetricsTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading metrics token: %s", err)
+		}
+		auth, err := bearerTokenAuth(strings.TrimSpace(string(token)))
+		if err != nil {
+			return nil, fmt.Errorf("error reading metrics token: %s", err)
+		}
+		s.auth = auth
+	case MetricsAuthMTLS:
+		ca, err := os.ReadFile(c.MetricsClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading metrics client CA: %s", err)
+		}
+		if s.tlsConfig == nil {
+			return nil, errors.New("a metrics serving certificate is required by mTLS")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("error reading metrics client CA: no certificate found in %s", c.MetricsClientCAFile)
+		}
+		s.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		s.tlsConfig.ClientCAs = pool
+		s.auth = clientCertAuth
+	}
+	return s, nil
+}
+
+// bearerTokenAuth returns the middleware rejecting requests without the bearer token.
+func bearerTokenAuth(token string) (func(http.Handler) http.Handler, error) {
+	if token == "" {
+		return nil, errors.New("token is empty")
+	}
+	expected := []byte("Bearer " + token)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// clientCertAuth rejects requests without a verified client certificate. The certificate is already verified
+// by the TLS handshake, this guards against serving the handler without the TLS config.
+func clientCertAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// addHandler registers an extra handler, the same as manager.Manager.AddMetricsExtraHandler.
+func (s *metricsServer) addHandler(path string, handler http.Handler) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.started {
+		return fmt.Errorf("unable to add new metrics handler because metrics endpoint has already been created")
+	}
+	if path == metricsPath {
+		return fmt.Errorf("overriding builtin %s endpoint is not allowed", metricsPath)
+	}
+	if _, found := s.handlers[path]; found {
+		return fmt.Errorf("can't register extra handler by duplicate path %q on metrics http server", path)
+	}
+	s.handlers[path] = handler
+	return nil
+}
+
+// handler returns the mux of the metrics endpoint and the extra handlers behind authentication.
+func (s *metricsServer) handler() http.Handler {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.started = true
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.HTTPErrorOnError,
+	}))
+	for path, h := range s.handlers {
+		mux.Handle(path, h)
+	}
+	return s.auth(mux)
+}
+
+// Start serves the metrics endpoint until ctx is done.
+func (s *metricsServer) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %s", s.addr, err)
+	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+	}
+	server := &http.Server{Handler: s.handler(), ReadHeaderTimeout: 32 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			klog.ErrorS(err, "error shutting down metrics server")
+		}
+	}()
+	klog.InfoS("serving metrics with authentication", "addr", s.addr, "tls", s.tlsConfig != nil)
+	if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every agent serves its own metrics.
+func (s *metricsServer) NeedLeaderElection() bool {
+	return false
+}
+
+// metricsManager registers the metrics extra handlers on the metricsServer instead of the metrics server of the manager.
+type metricsManager struct {
+	manager.Manager
+	server *metricsServer
+}
+
+func (m *metricsManager) AddMetricsExtraHandler(path string, handler http.Handler) error {
+	return m.server.addHandler(path, handler)
+}
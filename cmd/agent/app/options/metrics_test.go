@@ -0,0 +1,143 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBearerTokenAuth(t *testing.T) {
+	a := assert.New(t)
+	_, err := bearerTokenAuth("")
+	a.Error(err)
+
+	auth, err := bearerTokenAuth("secret")
+	a.NoError(err)
+	handler := auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	testcases := []struct {
+		name          string
+		authorization string
+		expectedCode  int
+	}{
+		{name: "valid-token", authorization: "Bearer secret", expectedCode: http.StatusOK},
+		{name: "no-token", expectedCode: http.StatusUnauthorized},
+		{name: "wrong-token", authorization: "Bearer secret2", expectedCode: http.StatusUnauthorized},
+		{name: "basic-auth", authorization: "Basic secret", expectedCode: http.StatusUnauthorized},
+	}
+	for _, v := range testcases {
+		t.Run(v.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, metricsPath, nil)
+			if v.authorization != "" {
+				req.Header.Set("Authorization", v.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, v.expectedCode, rec.Code)
+		})
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	a := assert.New(t)
+	handler := clientCertAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// plain HTTP
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	a.Equal(http.StatusUnauthorized, rec.Code)
+
+	// TLS without client certificate
+	req := httptest.NewRequest(http.MethodGet, metricsPath, nil)
+	req.TLS = &tls.ConnectionState{}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	a.Equal(http.StatusUnauthorized, rec.Code)
+
+	// TLS with verified client certificate
+	req = httptest.NewRequest(http.MethodGet, metricsPath, nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	a.Equal(http.StatusOK, rec.Code)
+}
+
+func TestMetricsServer_Handler(t *testing.T) {
+	a := assert.New(t)
+	auth, err := bearerTokenAuth("secret")
+	a.NoError(err)
+	s := &metricsServer{auth: auth, handlers: make(map[string]http.Handler)}
+	a.NoError(s.addHandler("/debug/status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	a.Error(s.addHandler("/debug/status", http.NotFoundHandler()))
+	a.Error(s.addHandler(metricsPath, http.NotFoundHandler()))
+
+	handler := s.handler()
+	for path, expectedCode := range map[string]int{metricsPath: http.StatusOK, "/debug/status": http.StatusTeapot} {
+		// the extra handlers are behind authentication too.
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		a.Equal(http.StatusUnauthorized, rec.Code)
+
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		a.Equal(expectedCode, rec.Code)
+	}
+
+	// handlers can not be added once the server is started.
+	a.Error(s.addHandler("/debug/flags/v", http.NotFoundHandler()))
+}
+
+func TestValidateMetricsAuth(t *testing.T) {
+	testcases := []struct {
+		name    string
+		options AgentOptions
+		valid   bool
+	}{
+		{name: "none", options: AgentOptions{MetricsAuthMode: MetricsAuthNone}, valid: true},
+		{name: "token", options: AgentOptions{MetricsAuthMode: MetricsAuthToken, MetricsTokenFile: "/etc/raven/token"}, valid: true},
+		{name: "token-without-file", options: AgentOptions{MetricsAuthMode: MetricsAuthToken}},
+		{name: "token-with-cert-only", options: AgentOptions{MetricsAuthMode: MetricsAuthToken, MetricsTokenFile: "/etc/raven/token",
+			MetricsTLSCertFile: "/etc/raven/tls.crt"}},
+		{name: "mtls", options: AgentOptions{MetricsAuthMode: MetricsAuthMTLS, MetricsClientCAFile: "/etc/raven/ca.crt",
+			MetricsTLSCertFile: "/etc/raven/tls.crt", MetricsTLSKeyFile: "/etc/raven/tls.key"}, valid: true},
+		{name: "mtls-without-cert", options: AgentOptions{MetricsAuthMode: MetricsAuthMTLS, MetricsClientCAFile: "/etc/raven/ca.crt"}},
+		{name: "unknown", options: AgentOptions{MetricsAuthMode: "basic"}},
+	}
+	for _, v := range testcases {
+		t.Run(v.name, func(t *testing.T) {
+			err := v.options.validateMetricsAuth()
+			if v.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -3,30 +3,82 @@ package options
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"time"
 
 	"github.com/openyurtio/openyurt/pkg/apis/raven/v1alpha1"
 	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	"github.com/openyurtio/raven/cmd/agent/app/config"
+	"github.com/openyurtio/raven/pkg/k8s"
 	"github.com/openyurtio/raven/pkg/networkengine/routedriver/vxlan"
+	networkutil "github.com/openyurtio/raven/pkg/networkengine/util"
 	"github.com/openyurtio/raven/pkg/networkengine/vpndriver/libreswan"
+	"github.com/openyurtio/raven/pkg/networkengine/vpndriver/wireguard"
+	"github.com/openyurtio/raven/pkg/utils"
 )
 
 // AgentOptions has the information that required by the raven agent
 type AgentOptions struct {
-	NodeName           string
-	Kubeconfig         string
-	VPNDriver          string
-	RouteDriver        string
-	ForwardNodeIP      bool
-	MetricsBindAddress string
+	NodeName                   string
+	Kubeconfig                 string
+	VPNDriver                  string
+	RouteDriver                string
+	ForwardNodeIP              bool
+	MetricsBindAddress         string
+	MetricsAuthMode            string
+	MetricsTokenFile           string
+	MetricsTLSCertFile         string
+	MetricsTLSKeyFile          string
+	MetricsClientCAFile        string
+	HealthProbeBindAddress     string
+	PublicIPAPIs               []string
+	PublicIPOverride           string
+	PublicIPCacheTTL           time.Duration
+	PublicIPRefreshInterval    time.Duration
+	WireGuardKeepAliveInterval time.Duration
+	WireGuardMTU               int
+	IPSecIKEVersion            int
+	IPSecIKEProposals          []string
+	IPSecESPProposals          []string
+	IPSecDPDDelay              time.Duration
+	IPSecDPDTimeout            time.Duration
+	IPSecDPDAction             string
+	IPSecFailureThreshold      int
+	IPSecFailureCooldown       time.Duration
+	IPSecMode                  string
+	RouteProtocol              int
+	MSSClamp                   bool
+	RelaySelector              string
+	ExcludeCIDRs               []string
+	StartupJitter              time.Duration
+	TracingEndpoint            string
+	TracingInsecure            bool
+	LinkStatsInterval          time.Duration
+	HeartbeatPort              int
+	HeartbeatInterval          time.Duration
+	HeartbeatTimeout           time.Duration
+	SyncTimeout                time.Duration
+	SyncStuckTimeout           time.Duration
+	ResyncPeriod               time.Duration
+	SyncRetryBaseDelay         time.Duration
+	SyncRetryMaxDelay          time.Duration
+	SyncMaxRetries             int
+	GatewayUpdateRetrySteps    int
+	GatewayUpdateRetryDelay    time.Duration
+	GatewayUpdateRetryFactor   float64
+	PreserveOnExit             bool
+	DryRun                     bool
 }
 
 // Validate validates the AgentOptions
@@ -37,6 +89,88 @@ func (o *AgentOptions) Validate() error {
 			return errors.New("either --node-name or $NODE_NAME has to be set")
 		}
 	}
+	if err := utils.ValidatePublicIPAPIs(o.PublicIPAPIs); err != nil {
+		return fmt.Errorf("invalid --public-ip-apis: %s", err)
+	}
+	if err := o.validateMetricsAuth(); err != nil {
+		return fmt.Errorf("invalid --metrics-auth-mode: %s", err)
+	}
+	if o.PublicIPOverride != "" && net.ParseIP(o.PublicIPOverride).To4() == nil {
+		return fmt.Errorf("invalid --public-ip: %q, must be an ipv4 address", o.PublicIPOverride)
+	}
+	if o.WireGuardKeepAliveInterval < 0 {
+		return fmt.Errorf("invalid --wireguard-keepalive-interval: %s, must not be negative", o.WireGuardKeepAliveInterval)
+	}
+	if err := libreswan.ValidateIKEVersion(o.IPSecIKEVersion); err != nil {
+		return fmt.Errorf("invalid --ipsec-ike-version: %s", err)
+	}
+	if err := libreswan.ValidateProposals(o.IPSecIKEProposals); err != nil {
+		return fmt.Errorf("invalid --ipsec-ike-proposals: %s", err)
+	}
+	if err := libreswan.ValidateProposals(o.IPSecESPProposals); err != nil {
+		return fmt.Errorf("invalid --ipsec-esp-proposals: %s", err)
+	}
+	if err := libreswan.ValidateDPDDurations(o.IPSecDPDDelay, o.IPSecDPDTimeout); err != nil {
+		return fmt.Errorf("invalid --ipsec-dpd-delay or --ipsec-dpd-timeout: %s", err)
+	}
+	if err := libreswan.ValidateDPDAction(o.IPSecDPDAction); err != nil {
+		return fmt.Errorf("invalid --ipsec-dpd-action: %s", err)
+	}
+	if o.IPSecFailureThreshold < 0 || o.IPSecFailureCooldown < 0 {
+		return fmt.Errorf("invalid --ipsec-failure-threshold or --ipsec-failure-cooldown: must not be negative")
+	}
+	if err := libreswan.ValidateMode(o.IPSecMode); err != nil {
+		return fmt.Errorf("invalid --ipsec-mode: %s", err)
+	}
+	if o.IPSecMode == libreswan.TransportMode && o.VPNDriver != "" && o.VPNDriver != libreswan.DriverName {
+		return fmt.Errorf("invalid --ipsec-mode: %s mode requires the %s vpn driver", libreswan.TransportMode, libreswan.DriverName)
+	}
+	if o.StartupJitter < 0 {
+		return fmt.Errorf("invalid --startup-jitter: %s, must not be negative", o.StartupJitter)
+	}
+	if o.LinkStatsInterval < 0 {
+		return fmt.Errorf("invalid --link-stats-interval: %s, must not be negative", o.LinkStatsInterval)
+	}
+	if o.HeartbeatPort < 0 || o.HeartbeatPort > 65535 {
+		return fmt.Errorf("invalid --heartbeat-port: %d, must be in range [0, 65535]", o.HeartbeatPort)
+	}
+	if o.HeartbeatPort != 0 && (o.HeartbeatInterval <= 0 || o.HeartbeatTimeout < o.HeartbeatInterval) {
+		return fmt.Errorf("invalid --heartbeat-interval or --heartbeat-timeout: interval must be positive and not greater than timeout")
+	}
+	if o.SyncTimeout < 0 {
+		return fmt.Errorf("invalid --sync-timeout: %s, must not be negative", o.SyncTimeout)
+	}
+	if o.SyncStuckTimeout < 0 {
+		return fmt.Errorf("invalid --sync-stuck-timeout: %s, must not be negative", o.SyncStuckTimeout)
+	}
+	if o.ResyncPeriod < 0 {
+		return fmt.Errorf("invalid --resync-period: %s, must not be negative", o.ResyncPeriod)
+	}
+	if o.SyncRetryBaseDelay <= 0 || o.SyncRetryMaxDelay < o.SyncRetryBaseDelay {
+		return fmt.Errorf("invalid --sync-retry-base-delay or --sync-retry-max-delay: base delay must be positive and not greater than max delay")
+	}
+	if o.SyncMaxRetries < 0 {
+		return fmt.Errorf("invalid --sync-max-retries: %d, must not be negative", o.SyncMaxRetries)
+	}
+	if o.GatewayUpdateRetrySteps <= 0 || o.GatewayUpdateRetryDelay <= 0 || o.GatewayUpdateRetryFactor < 1 {
+		return fmt.Errorf("invalid --gateway-update-retry-steps, --gateway-update-retry-delay or --gateway-update-retry-factor: " +
+			"steps and delay must be positive, and factor must not be less than 1")
+	}
+	// 0-4 are reserved by the kernel, and protocol is an 8-bit value.
+	if o.RouteProtocol <= 4 || o.RouteProtocol > 255 {
+		return fmt.Errorf("invalid --route-protocol: %d, must be in range (4, 255]", o.RouteProtocol)
+	}
+	if o.WireGuardMTU < 0 {
+		return fmt.Errorf("invalid --wireguard-mtu: %d, must not be negative", o.WireGuardMTU)
+	}
+	if _, err := labels.Parse(o.RelaySelector); err != nil {
+		return fmt.Errorf("invalid --relay-selector: %s", err)
+	}
+	for _, cidr := range o.ExcludeCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid --exclude-cidrs: %s", err)
+		}
+	}
 	return nil
 }
 
@@ -48,17 +182,107 @@ func (o *AgentOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&o.RouteDriver, "route-driver", o.RouteDriver, `The Route driver name. (default "vxlan")`)
 	fs.BoolVar(&o.ForwardNodeIP, "forward-node-ip", o.ForwardNodeIP, `Forward node IP or not. (default "false")`)
 	fs.StringVar(&o.MetricsBindAddress, "metric-bind-addr", o.MetricsBindAddress, `Binding address of metrics. (default ":8080")`)
+	fs.StringVar(&o.MetricsAuthMode, "metrics-auth-mode", MetricsAuthNone, `The authentication of the metrics endpoint, one of "none", "token" and "mtls".`)
+	fs.StringVar(&o.MetricsTokenFile, "metrics-token-file", o.MetricsTokenFile, `The file of the bearer token required by the metrics endpoint in the "token" mode.`)
+	fs.StringVar(&o.MetricsTLSCertFile, "metrics-tls-cert-file", o.MetricsTLSCertFile, `The serving certificate of the metrics endpoint. It is served over plain HTTP if not set, which is not allowed in the "mtls" mode.`)
+	fs.StringVar(&o.MetricsTLSKeyFile, "metrics-tls-key-file", o.MetricsTLSKeyFile, `The private key of --metrics-tls-cert-file.`)
+	fs.StringVar(&o.MetricsClientCAFile, "metrics-client-ca-file", o.MetricsClientCAFile, `The CA bundle verifying the client certificates of the metrics endpoint in the "mtls" mode.`)
+	fs.StringVar(&o.HealthProbeBindAddress, "health-probe-bind-addr", o.HealthProbeBindAddress, `Binding address of /healthz and /readyz. They are disabled if not set.`)
+	fs.DurationVar(&o.PublicIPCacheTTL, "public-ip-cache-ttl", utils.DefaultPublicIPCacheTTL, `How long a detected public IP is reused before detecting again. Set to 0 to disable the cache.`)
+	fs.DurationVar(&o.PublicIPRefreshInterval, "public-ip-refresh-interval", 10*time.Minute, `The interval to detect public IP of the local active endpoint again, and update the gateway if it changed. Set to 0 to disable.`)
+	fs.StringSliceVar(&o.PublicIPAPIs, "public-ip-apis", o.PublicIPAPIs, `The APIs used to detect public IP of gateway node, in order of preference. The built-in APIs are used if not set.`)
+	fs.StringVar(&o.PublicIPOverride, "public-ip", o.PublicIPOverride, `The public IP of this node, used instead of detecting it by the public IP APIs, e.g. the IP of a static load balancer in front of the gateway.`)
+	fs.DurationVar(&o.WireGuardKeepAliveInterval, "wireguard-keepalive-interval", wireguard.KeepAliveInterval, `The persistent keepalive interval of WireGuard peers. Set to 0 to disable. The default is the 5s interval raven always used before the option, so that upgrading keeps the NAT mappings of idle peers alive.`)
+	fs.IntVar(&o.WireGuardMTU, "wireguard-mtu", o.WireGuardMTU, `The MTU of the WireGuard device. It is computed from the default route link if not set.`)
+	fs.IntVar(&o.IPSecIKEVersion, "ipsec-ike-version", o.IPSecIKEVersion, `The IKE version of libreswan connections, 1 or 2. The libreswan default is used if not set.`)
+	fs.StringSliceVar(&o.IPSecIKEProposals, "ipsec-ike-proposals", o.IPSecIKEProposals, `The IKE proposals of libreswan connections, e.g. "aes_gcm256-sha384;dh20". The libreswan defaults are used if not set.`)
+	fs.StringSliceVar(&o.IPSecESPProposals, "ipsec-esp-proposals", o.IPSecESPProposals, `The ESP proposals of libreswan connections, e.g. "aes_gcm256". The libreswan defaults are used if not set.`)
+	fs.DurationVar(&o.IPSecDPDDelay, "ipsec-dpd-delay", 0, `The dead peer detection interval of libreswan connections, e.g. 30s for flaky edge links. Dead peer detection is disabled by default, set a positive interval to enable it.`)
+	fs.DurationVar(&o.IPSecDPDTimeout, "ipsec-dpd-timeout", libreswan.DefaultDPDTimeout, `How long a libreswan peer is unresponsive before it is declared dead.`)
+	fs.StringVar(&o.IPSecDPDAction, "ipsec-dpd-action", libreswan.DefaultDPDAction, `The action when a libreswan peer is declared dead, one of "clear", "hold" and "restart".`)
+	fs.IntVar(&o.IPSecFailureThreshold, "ipsec-failure-threshold", o.IPSecFailureThreshold, `How many times in a row a libreswan connection fails before it is not retried for --ipsec-failure-cooldown. Set to 0 to always retry. (default "0")`)
+	fs.DurationVar(&o.IPSecFailureCooldown, "ipsec-failure-cooldown", libreswan.DefaultFailureCooldown, `How long a libreswan connection that failed too many times in a row is not retried.`)
+	fs.StringVar(&o.IPSecMode, "ipsec-mode", libreswan.TunnelMode, `The IPSec mode of libreswan connections, "tunnel" or "transport". Transport mode has 20 bytes less overhead per packet, but only applies to host-to-host subnets: the connections whose subnets are the addresses of the gateways themselves, e.g. 192.168.0.1/32, with none of the gateways behind NAT. The connections between other subnets, such as the pod subnets, are not made and the agent is not ready.`)
+	fs.IntVar(&o.RouteProtocol, "route-protocol", networkutil.DefaultRouteProtocol, `The protocol (rtproto) of routes added by raven. Only routes with this protocol are deleted on cleanup.`)
+	fs.BoolVar(&o.MSSClamp, "mss-clamp", o.MSSClamp, `Clamp the TCP MSS of traffic sent to remote subnets to fit the tunnel MTU. (default "false")`)
+	fs.StringVar(&o.RelaySelector, "relay-selector", o.RelaySelector, `The label selector of the public gateways preferred to relay traffic between gateways behind NAT, e.g. "raven.openyurt.io/relay=true". It must be the same on all agents.`)
+	fs.StringSliceVar(&o.ExcludeCIDRs, "exclude-cidrs", o.ExcludeCIDRs, `The destination CIDRs that never go through the tunnel, e.g. "169.254.169.254/32".`)
+	fs.DurationVar(&o.StartupJitter, "startup-jitter", o.StartupJitter, `The max random delay before syncing the first time, to spread the load on the API server and public IP APIs when many agents start at once. (default "0s")`)
+	fs.StringVar(&o.TracingEndpoint, "tracing-endpoint", o.TracingEndpoint, `The OTLP gRPC endpoint the traces of syncs are exported to, e.g. "otel-collector.monitoring:4317". Tracing is disabled if not set.`)
+	fs.BoolVar(&o.TracingInsecure, "tracing-insecure", o.TracingInsecure, `Connect to the tracing endpoint without TLS. (default "false")`)
+	fs.DurationVar(&o.LinkStatsInterval, "link-stats-interval", 0, `The interval to sample the statistics of the vxlan and WireGuard links for metrics, e.g. 30s. The sampling is disabled by default, set a positive interval to enable it.`)
+	fs.IntVar(&o.HeartbeatPort, "heartbeat-port", o.HeartbeatPort, `The UDP port of the heartbeats between gateways, which measure the round trip time and detect unreachable gateways. It must be the same on all agents. Heartbeats are disabled if not set.`)
+	fs.DurationVar(&o.HeartbeatInterval, "heartbeat-interval", k8s.DefaultHeartbeatInterval, `The interval to send heartbeats to the remote gateways.`)
+	fs.DurationVar(&o.HeartbeatTimeout, "heartbeat-timeout", k8s.DefaultHeartbeatTimeout, `How long a remote gateway does not answer heartbeats before it is unhealthy.`)
+	fs.DurationVar(&o.SyncTimeout, "sync-timeout", time.Minute, `The timeout of a sync, including the driver calls. A timed out sync is retried, a timed out driver call is abandoned and blocks the following driver calls until it returns. Set to 0 to disable.`)
+	fs.DurationVar(&o.SyncStuckTimeout, "sync-stuck-timeout", 10*time.Minute, `How long a sync or a driver call may run before /healthz fails, so that an agent blocked by a hung driver call is restarted. Set to 0 to disable.`)
+	fs.DurationVar(&o.ResyncPeriod, "resync-period", 0, `The interval to apply the network to the drivers even without gateway events, to correct drifted routes and vpn connections, e.g. 1m. The resync is disabled by default, set a positive interval to enable it.`)
+	fs.DurationVar(&o.SyncRetryBaseDelay, "sync-retry-base-delay", k8s.DefaultSyncRetryBaseDelay, `The initial delay of retrying a failed sync, doubled on each consecutive failure.`)
+	fs.DurationVar(&o.SyncRetryMaxDelay, "sync-retry-max-delay", k8s.DefaultSyncRetryMaxDelay, `The max delay of retrying a failed sync.`)
+	fs.IntVar(&o.SyncMaxRetries, "sync-max-retries", k8s.DefaultSyncMaxRetries, `How many times a failed sync is retried before the event is dropped. The next gateway event triggers a sync again.`)
+	fs.IntVar(&o.GatewayUpdateRetrySteps, "gateway-update-retry-steps", retry.DefaultBackoff.Steps, `How many times a conflicting gateway update is tried.`)
+	fs.DurationVar(&o.GatewayUpdateRetryDelay, "gateway-update-retry-delay", retry.DefaultBackoff.Duration, `The initial delay of retrying a conflicting gateway update.`)
+	fs.Float64Var(&o.GatewayUpdateRetryFactor, "gateway-update-retry-factor", retry.DefaultBackoff.Factor, `The factor the delay of retrying a conflicting gateway update is multiplied by on each retry.`)
+	fs.BoolVar(&o.PreserveOnExit, "preserve-on-exit", o.PreserveOnExit, `Keep the routes, iptables rules and the WireGuard device on graceful shutdown, and adopt them on the next start, so that WireGuard tunnels keep flowing during a restart. The libreswan connections are re-established by the next agent. (default "false")`)
+	fs.BoolVar(&o.DryRun, "dry-run", o.DryRun, `Only log the desired network instead of initializing the drivers and applying it. Link statistics and heartbeats are disabled too. (default "false")`)
 }
 
 // Config return a raven agent config objective
 func (o *AgentOptions) Config() (*config.Config, error) {
 	var err error
 	c := &config.Config{
-		NodeName:           o.NodeName,
-		VPNDriver:          o.VPNDriver,
-		RouteDriver:        o.RouteDriver,
-		ForwardNodeIP:      o.ForwardNodeIP,
-		MetricsBindAddress: o.MetricsBindAddress,
+		NodeName:                   o.NodeName,
+		VPNDriver:                  o.VPNDriver,
+		RouteDriver:                o.RouteDriver,
+		ForwardNodeIP:              o.ForwardNodeIP,
+		MetricsBindAddress:         o.MetricsBindAddress,
+		MetricsAuthMode:            o.MetricsAuthMode,
+		MetricsAuthenticated:       o.MetricsAuthMode != "" && o.MetricsAuthMode != MetricsAuthNone && o.MetricsBindAddress != "0",
+		MetricsTokenFile:           o.MetricsTokenFile,
+		MetricsTLSCertFile:         o.MetricsTLSCertFile,
+		MetricsTLSKeyFile:          o.MetricsTLSKeyFile,
+		MetricsClientCAFile:        o.MetricsClientCAFile,
+		HealthProbeBindAddress:     o.HealthProbeBindAddress,
+		PublicIPAPIs:               o.PublicIPAPIs,
+		PublicIPOverride:           o.PublicIPOverride,
+		PublicIPCacheTTL:           o.PublicIPCacheTTL,
+		PublicIPRefreshInterval:    o.PublicIPRefreshInterval,
+		WireGuardKeepAliveInterval: o.WireGuardKeepAliveInterval,
+		WireGuardMTU:               o.WireGuardMTU,
+		IPSecIKEVersion:            o.IPSecIKEVersion,
+		IPSecIKEProposals:          o.IPSecIKEProposals,
+		IPSecESPProposals:          o.IPSecESPProposals,
+		IPSecDPDDelay:              o.IPSecDPDDelay,
+		IPSecDPDTimeout:            o.IPSecDPDTimeout,
+		IPSecDPDAction:             o.IPSecDPDAction,
+		IPSecFailureThreshold:      o.IPSecFailureThreshold,
+		IPSecFailureCooldown:       o.IPSecFailureCooldown,
+		IPSecMode:                  o.IPSecMode,
+		RouteProtocol:              o.RouteProtocol,
+		MSSClamp:                   o.MSSClamp,
+		RelaySelector:              o.RelaySelector,
+		ExcludeCIDRs:               o.ExcludeCIDRs,
+		StartupJitter:              o.StartupJitter,
+		TracingEndpoint:            o.TracingEndpoint,
+		TracingInsecure:            o.TracingInsecure,
+		LinkStatsInterval:          o.LinkStatsInterval,
+		HeartbeatPort:              o.HeartbeatPort,
+		HeartbeatInterval:          o.HeartbeatInterval,
+		HeartbeatTimeout:           o.HeartbeatTimeout,
+		SyncTimeout:                o.SyncTimeout,
+		SyncStuckTimeout:           o.SyncStuckTimeout,
+		ResyncPeriod:               o.ResyncPeriod,
+		SyncRetryBaseDelay:         o.SyncRetryBaseDelay,
+		SyncRetryMaxDelay:          o.SyncRetryMaxDelay,
+		SyncMaxRetries:             o.SyncMaxRetries,
+		PreserveOnExit:             o.PreserveOnExit,
+		DryRun:                     o.DryRun,
+		GatewayUpdateRetry: wait.Backoff{
+			Steps:    o.GatewayUpdateRetrySteps,
+			Duration: o.GatewayUpdateRetryDelay,
+			Factor:   o.GatewayUpdateRetryFactor,
+			Jitter:   retry.DefaultBackoff.Jitter,
+		},
 	}
 	cfg, err := clientcmd.BuildConfigFromFlags("", o.Kubeconfig)
 	if err != nil {
@@ -66,7 +290,7 @@ func (o *AgentOptions) Config() (*config.Config, error) {
 	}
 	cfg = restclient.AddUserAgent(cfg, "raven-agent")
 	c.Kubeconfig = cfg
-	c.Manager, err = newMgr(cfg, c.MetricsBindAddress)
+	c.Manager, err = newMgr(cfg, c)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create manager: %s", err)
 	}
@@ -79,12 +303,18 @@ func (o *AgentOptions) Config() (*config.Config, error) {
 	return c, err
 }
 
-func newMgr(cfg *restclient.Config, metricsBindAddress string) (manager.Manager, error) {
+func newMgr(cfg *restclient.Config, c *config.Config) (manager.Manager, error) {
 	scheme := runtime.NewScheme()
 	_ = v1alpha1.AddToScheme(scheme)
 	opt := ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: metricsBindAddress,
+		Scheme:                 scheme,
+		MetricsBindAddress:     c.MetricsBindAddress,
+		HealthProbeBindAddress: c.HealthProbeBindAddress,
+	}
+	// The metrics server of the manager can not be wrapped by a middleware, so it is replaced by metricsServer.
+	authenticated := c.MetricsAuthenticated
+	if authenticated {
+		opt.MetricsBindAddress = "0"
 	}
 
 	mgr, err := ctrl.NewManager(cfg, opt)
@@ -92,5 +322,15 @@ func newMgr(cfg *restclient.Config, metricsBindAddress string) (manager.Manager,
 		klog.ErrorS(err, "failed to new manager for raven agent controller")
 		return nil, err
 	}
-	return mgr, nil
+	if !authenticated {
+		return mgr, nil
+	}
+	server, err := newMetricsServer(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := mgr.Add(server); err != nil {
+		return nil, fmt.Errorf("failed to add metrics server: %s", err)
+	}
+	return &metricsManager{Manager: mgr, server: server}, nil
 }
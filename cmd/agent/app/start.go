@@ -19,17 +19,24 @@ package app
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/vdobler/ht/errorlist"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 
 	"github.com/openyurtio/raven/cmd/agent/app/config"
 	"github.com/openyurtio/raven/cmd/agent/app/options"
 	"github.com/openyurtio/raven/pkg/k8s"
 	"github.com/openyurtio/raven/pkg/networkengine/routedriver"
+	networkutil "github.com/openyurtio/raven/pkg/networkengine/util"
 	"github.com/openyurtio/raven/pkg/networkengine/vpndriver"
 )
 
+// shutdownTimeout bounds waiting for the in-flight syncs on shutdown, before cleaning up the drivers.
+const shutdownTimeout = 10 * time.Second
+
 // NewRavenAgentCommand creates a new raven agent command
 func NewRavenAgentCommand(ctx context.Context) *cobra.Command {
 	agentOptions := &options.AgentOptions{}
@@ -57,38 +64,122 @@ func NewRavenAgentCommand(ctx context.Context) *cobra.Command {
 
 // Run starts the raven-agent
 func Run(ctx context.Context, cfg *config.CompletedConfig) error {
-	routeDriver, err := routedriver.New(cfg.RouteDriver, cfg.Config)
+	shutdownTracing, err := setupTracing(ctx, cfg.Config)
 	if err != nil {
-		return fmt.Errorf("fail to create route driver: %s, %s", cfg.RouteDriver, err)
+		return err
 	}
-	err = routeDriver.Init()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			klog.ErrorS(err, "error flushing traces")
+		}
+	}()
+	routeDriver, err := routedriver.New(cfg.RouteDriver, cfg.Config)
 	if err != nil {
-		return fmt.Errorf("fail to initialize route driver: %s, %s", cfg.RouteDriver, err)
+		return fmt.Errorf("fail to create route driver: %s, %s", cfg.RouteDriver, err)
 	}
-	klog.Infof("route driver %s initialized", cfg.RouteDriver)
 	vpnDriver, err := vpndriver.New(cfg.VPNDriver, cfg.Config)
 	if err != nil {
 		return fmt.Errorf("fail to create vpn driver: %s, %s", cfg.VPNDriver, err)
 	}
-	err = vpnDriver.Init()
-	if err != nil {
-		return fmt.Errorf("fail to initialize vpn driver: %s, %s", cfg.VPNDriver, err)
+	if cfg.DryRun {
+		klog.Info("running in dry run mode, the drivers will not be initialized")
+	} else {
+		if err = preflightDrivers(routeDriver, vpnDriver); err != nil {
+			recordPreflightFailure(ctx, cfg.Config, err)
+			return err
+		}
+		err = routeDriver.Init()
+		if err != nil {
+			return fmt.Errorf("fail to initialize route driver: %s, %s", cfg.RouteDriver, err)
+		}
+		klog.InfoS("route driver initialized", "routeDriver", cfg.RouteDriver, "node", cfg.NodeName)
+		err = vpnDriver.Init()
+		if err != nil {
+			// vpn driver may be partially initialized, so clean up both of them.
+			if e := cleanupDrivers(routeDriver, vpnDriver); e != nil {
+				klog.ErrorS(e, "error cleaning up drivers")
+			}
+			return fmt.Errorf("fail to initialize vpn driver: %s, %s", cfg.VPNDriver, err)
+		}
+		klog.InfoS("VPN driver initialized", "vpnDriver", cfg.VPNDriver, "node", cfg.NodeName)
 	}
-	klog.Infof("VPN driver %s initialized", cfg.VPNDriver)
 	// start network engine controller
-	ec, err := k8s.NewEngineController(cfg.NodeName, cfg.ForwardNodeIP, routeDriver, cfg.Manager, vpnDriver)
+	ec, err := k8s.NewEngineController(cfg.Config, routeDriver, vpnDriver)
 	if err != nil {
+		if !cfg.DryRun {
+			if e := cleanupDrivers(routeDriver, vpnDriver); e != nil {
+				klog.ErrorS(e, "error cleaning up drivers")
+			}
+		}
 		return fmt.Errorf("could not create network engine controller: %s", err)
 	}
 	ec.Start(ctx)
 	<-ctx.Done()
-	err = routeDriver.Cleanup()
-	if err != nil {
-		klog.Errorf("route driver fail to cleanup: %s", err)
+	// ctx is already done, so a new context bounds the shutdown.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := ec.Shutdown(shutdownCtx); err != nil {
+		klog.ErrorS(err, "error shutting down engine controller")
 	}
-	err = vpnDriver.Cleanup()
-	if err != nil {
-		klog.Errorf("vpn driver fail to cleanup: %s", err)
+	if cfg.DryRun {
+		return nil
+	}
+	if cfg.PreserveOnExit {
+		// The drivers diff the current state on node against the desired network in Apply,
+		// so the next agent adopts the preserved routes and WireGuard device, and corrects any stale part of them.
+		// The WireGuard device keeps its key, so the peers are not affected by the restart.
+		// The libreswan connections are not preserved, pluto exits with the agent.
+		klog.InfoS("preserving routes, iptables rules and the wireguard device on exit", "node", cfg.NodeName)
+		return nil
+	}
+	return cleanupDrivers(routeDriver, vpnDriver)
+}
+
+// preflightDrivers checks the prerequisites of the drivers implementing networkutil.Preflighter,
+// and returns an error naming the missing prerequisite.
+func preflightDrivers(routeDriver routedriver.Driver, vpnDriver vpndriver.Driver) error {
+	if p, ok := routeDriver.(networkutil.Preflighter); ok {
+		if err := p.Preflight(); err != nil {
+			return fmt.Errorf("route driver preflight check failed: %s", err)
+		}
+	}
+	if p, ok := vpnDriver.(networkutil.Preflighter); ok {
+		if err := p.Preflight(); err != nil {
+			return fmt.Errorf("vpn driver preflight check failed: %s", err)
+		}
 	}
 	return nil
 }
+
+// recordPreflightFailure records the failed preflight check on the local gateway, so that it is visible without the
+// container log. It is best effort, the agent exits with the preflight error anyway.
+func recordPreflightFailure(ctx context.Context, cfg *config.Config, checkErr error) {
+	clientset, err := kubernetes.NewForConfig(cfg.Kubeconfig)
+	if err != nil {
+		klog.ErrorS(err, "error creating kube client, the preflight failure is not recorded")
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	if err := k8s.RecordPreflightFailure(ctx, cfg.Manager.GetAPIReader(), clientset.CoreV1(), cfg.NodeName, checkErr); err != nil {
+		klog.ErrorS(err, "error recording the preflight failure")
+	}
+}
+
+// cleanupDrivers cleans up the given drivers and returns the combined error, nil drivers are skipped.
+func cleanupDrivers(routeDriver routedriver.Driver, vpnDriver vpndriver.Driver) error {
+	errList := errorlist.List{}
+	if routeDriver != nil {
+		if err := routeDriver.Cleanup(); err != nil {
+			errList = errList.Append(fmt.Errorf("route driver fail to cleanup: %s", err))
+		}
+	}
+	if vpnDriver != nil {
+		if err := vpnDriver.Cleanup(); err != nil {
+			errList = errList.Append(fmt.Errorf("vpn driver fail to cleanup: %s", err))
+		}
+	}
+	return errList.AsError()
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openyurtio/raven/pkg/networkengine/routedriver"
+	enginetesting "github.com/openyurtio/raven/pkg/networkengine/testing"
+	"github.com/openyurtio/raven/pkg/networkengine/vpndriver"
+)
+
+func TestCleanupDrivers(t *testing.T) {
+	testcases := []struct {
+		name        string
+		routeDriver *enginetesting.RouteDriver
+		vpnDriver   *enginetesting.VPNDriver
+		expectErr   bool
+	}{
+		{
+			name: "both-nil",
+		},
+		{
+			name:        "vpn-driver-nil",
+			routeDriver: &enginetesting.RouteDriver{},
+		},
+		{
+			name:      "route-driver-nil",
+			vpnDriver: &enginetesting.VPNDriver{},
+		},
+		{
+			name:        "both-drivers",
+			routeDriver: &enginetesting.RouteDriver{},
+			vpnDriver:   &enginetesting.VPNDriver{},
+		},
+		{
+			name:        "both-drivers-fail",
+			routeDriver: &enginetesting.RouteDriver{Driver: enginetesting.Driver{CleanupErr: errors.New("route")}},
+			vpnDriver:   &enginetesting.VPNDriver{Driver: enginetesting.Driver{CleanupErr: errors.New("vpn")}},
+			expectErr:   true,
+		},
+	}
+	for _, v := range testcases {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			// avoid passing typed nil pointers as non-nil interfaces.
+			var routeDriver routedriver.Driver
+			var vpnDriver vpndriver.Driver
+			if v.routeDriver != nil {
+				routeDriver = v.routeDriver
+			}
+			if v.vpnDriver != nil {
+				vpnDriver = v.vpnDriver
+			}
+			err := cleanupDrivers(routeDriver, vpnDriver)
+			if v.expectErr {
+				a.Error(err)
+				a.Contains(err.Error(), "route")
+				a.Contains(err.Error(), "vpn")
+			} else {
+				a.NoError(err)
+			}
+			if v.routeDriver != nil {
+				a.Equal(1, v.routeDriver.CleanupCalls())
+			}
+			if v.vpnDriver != nil {
+				a.Equal(1, v.vpnDriver.CleanupCalls())
+			}
+		})
+	}
+}
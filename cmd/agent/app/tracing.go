@@ -0,0 +1,62 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package app
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/klog/v2"
+
+	"github.com/openyurtio/raven/cmd/agent/app/config"
+)
+
+// setupTracing installs the tracer provider exporting spans to cfg.TracingEndpoint, and returns the function
+// flushing the pending spans on shutdown. If no endpoint is set, the default no-op tracer provider is kept.
+func setupTracing(ctx context.Context, cfg *config.Config) (func(context.Context) error, error) {
+	if cfg.TracingEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlpgrpc.Option{otlpgrpc.WithEndpoint(cfg.TracingEndpoint)}
+	if cfg.TracingInsecure {
+		opts = append(opts, otlpgrpc.WithInsecure())
+	} else {
+		opts = append(opts, otlpgrpc.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, "")))
+	}
+	exporter, err := otlp.NewExporter(ctx, otlpgrpc.NewDriver(opts...))
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace exporter: %s", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.ServiceNameKey.String("raven-agent"),
+			attribute.String("k8s.node.name", cfg.NodeName),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	klog.InfoS("exporting traces", "endpoint", cfg.TracingEndpoint)
+	return tp.Shutdown, nil
+}
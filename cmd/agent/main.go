@@ -24,6 +24,7 @@ import (
 	"k8s.io/apiserver/pkg/server"
 
 	"github.com/openyurtio/raven/cmd/agent/app"
+	"github.com/openyurtio/raven/pkg/k8s"
 	_ "github.com/openyurtio/raven/pkg/networkengine/routedriver/vxlan"
 	_ "github.com/openyurtio/raven/pkg/networkengine/vpndriver/libreswan"
 	_ "github.com/openyurtio/raven/pkg/networkengine/vpndriver/wireguard"
@@ -32,6 +33,8 @@ import (
 func main() {
 	rand.Seed(time.Now().UnixNano())
 	cmd := app.NewRavenAgentCommand(server.SetupSignalContext())
+	// --v and --vmodule set the log verbosity, they can also be changed at runtime on the metrics server.
+	k8s.AddLogFlags(cmd.Flags())
 	cmd.Flags().AddGoFlagSet(flag.CommandLine)
 	if err := cmd.Execute(); err != nil {
 		panic(err)
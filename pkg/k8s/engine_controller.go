@@ -17,15 +17,28 @@
 package k8s
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"math/rand"
 	"net"
+	"net/http"
 	"reflect"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/EvilSuperstars/go-cidrman"
 	"github.com/openyurtio/openyurt/pkg/apis/raven/v1alpha1"
+	"github.com/vdobler/ht/errorlist"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
@@ -37,6 +50,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	"github.com/openyurtio/raven/cmd/agent/app/config"
 	"github.com/openyurtio/raven/pkg/networkengine/routedriver"
 	"github.com/openyurtio/raven/pkg/networkengine/vpndriver"
 	"github.com/openyurtio/raven/pkg/types"
@@ -44,35 +58,150 @@ import (
 )
 
 const (
-	maxRetries = 30
+	// DefaultSyncRetryBaseDelay, DefaultSyncRetryMaxDelay and DefaultSyncMaxRetries are the defaults of
+	// retrying a failed sync, the same as workqueue.DefaultControllerRateLimiter.
+	DefaultSyncRetryBaseDelay = 5 * time.Millisecond
+	DefaultSyncRetryMaxDelay  = 1000 * time.Second
+	DefaultSyncMaxRetries     = 30
+
+	// EventPublicIPDetectionFailed is the event reason indicating public IP of the local active endpoint can not be detected.
+	EventPublicIPDetectionFailed = "PublicIPDetectionFailed"
+	// EventPublicIPDetected is the event reason indicating public IP is detected after previous failures.
+	EventPublicIPDetected = "PublicIPDetected"
+	// EventNATTypeChanged is the event reason indicating the active endpoint of the gateway moved behind NAT or out of it.
+	EventNATTypeChanged = "NATTypeChanged"
+	// EventGatewayDrainStarted and EventGatewayDrainCompleted are the event reasons indicating the gateway is being
+	// withdrawn from the network because of DrainAnnotation, and the withdrawal is applied by the drivers.
+	EventGatewayDrainStarted   = "GatewayDrainStarted"
+	EventGatewayDrainCompleted = "GatewayDrainCompleted"
+	// EventInvalidGateway is the event reason indicating the gateway is skipped because it is malformed.
+	EventInvalidGateway = "InvalidGateway"
+
+	// PublicDNSNameKey is the endpoint config key of a DNS name resolving to the public IP of the endpoint,
+	// e.g. a dynamic DNS name of a gateway with a volatile public IP. It is resolved on every sync,
+	// and takes precedence over the public IP of the endpoint unless it can not be resolved.
+	PublicDNSNameKey = "publicDNSName"
+
+	// DrainAnnotation withdraws the gateway from the network when it is "true", e.g. for node maintenance.
+	// Its subnets are not routed and its vpn connections are torn down, until the annotation is removed.
+	DrainAnnotation = "raven.openyurt.io/drain"
+
+	// resyncKey is the queue key of periodic resync, which is not a valid gateway name.
+	resyncKey = "raven-agent/resync"
 )
 
+// can be modified for testing.
+var lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip4", host)
+}
+
 type EngineController struct {
 	nodeName      string
 	forwardNodeIP bool
+	// relaySelector selects the gateways preferred to relay traffic between NATed gateways, nil selects none.
+	relaySelector labels.Selector
+	dryRun        bool
 	nodeInfos     map[types.NodeName]*v1alpha1.NodeInfo
 	network       *types.Network
 	// lastSeenNetwork tracks the last seen Network.
 	lastSeenNetwork *types.Network
 
+	publicIP utils.PublicIPResolver
+	// publicIPRefreshInterval is the interval to detect public IP of the local active endpoint again.
+	publicIPRefreshInterval time.Duration
+	// publicIPFailed records gateways whose public IP detection failed last time, indexed by gateway name.
+	publicIPFailed      map[string]bool
+	publicIPFailedMutex sync.Mutex
+
+	recorder record.EventRecorder
+	// drainedGateways records the gateways drained by DrainAnnotation, true once the drain is applied by the drivers.
+	drainedGateways map[string]bool
+	// natTypes records the NAT type of the active endpoint of each gateway seen in the last sync, indexed by gateway name.
+	natTypes map[string]string
+
+	// lastSyncErr, lastSyncTime and appliedNetwork record the result of the most recent sync,
+	// for readiness check and the status endpoint.
+	lastSyncErr     error
+	lastSyncTime    time.Time
+	appliedNetwork  *types.Network
+	syncStatusMutex sync.RWMutex
+	// syncStartTime is when the in-flight sync started, zero if no sync is running, for liveness check.
+	syncStartTime time.Time
+	// syncTimeout bounds a sync, including its driver calls, 0 disables it.
+	syncTimeout time.Duration
+	// syncStuckTimeout is how long a sync or a driver call may run before the liveness check fails, 0 disables it.
+	syncStuckTimeout time.Duration
+	// driverCallStartTime is when the running driver call started, zero if none is running, for liveness check.
+	driverCallStartTime time.Time
+	// driverMutex serializes the driver calls. A call abandoned by a timed out sync holds it until the call returns,
+	// so that the following syncs do not race it on the driver state.
+	driverMutex sync.Mutex
+
 	manager manager.Manager
 
 	ravenClient client.Client
 	queue       workqueue.RateLimitingInterface
+	// workers tracks the running workers, for graceful shutdown.
+	workers sync.WaitGroup
+	// startupJitter is the max random delay before the engine controller starts, 0 disables it.
+	startupJitter time.Duration
+	// resyncPeriod is the interval to apply the network to the drivers even if it is not changed, 0 disables it.
+	resyncPeriod time.Duration
+	// linkStatsInterval is the interval to sample the statistics of the links managed by the drivers, 0 disables it.
+	linkStatsInterval time.Duration
+	// heartbeat checks the remote gateways with heartbeats, nil if heartbeats are disabled.
+	heartbeat *heartbeater
+	// maxRetries is how many times a failed sync is retried before the event is dropped.
+	maxRetries int
+	// updateBackoff is the backoff of retrying conflicting Gateway updates.
+	updateBackoff wait.Backoff
+	// syncErrorLogs deduplicates the logs of failed syncs.
+	syncErrorLogs errorLogFilter
 
 	routeDriver routedriver.Driver
 	vpnDriver   vpndriver.Driver
+	// routeDriverName and vpnDriverName are used as metric labels.
+	routeDriverName string
+	vpnDriverName   string
 }
 
-func NewEngineController(nodeName string, forwardNodeIP bool, routeDriver routedriver.Driver, manager manager.Manager,
-	vpnDriver vpndriver.Driver) (*EngineController, error) {
+func NewEngineController(cfg *config.Config, routeDriver routedriver.Driver, vpnDriver vpndriver.Driver) (*EngineController, error) {
+	publicIP := utils.NewPublicIPResolver(utils.PublicIPConfig{
+		APIs:     cfg.PublicIPAPIs,
+		CacheTTL: cfg.PublicIPCacheTTL,
+		Override: cfg.PublicIPOverride,
+	})
+	var relaySelector labels.Selector
+	if cfg.RelaySelector != "" {
+		selector, err := labels.Parse(cfg.RelaySelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay selector: %s", err)
+		}
+		relaySelector = selector
+	}
 	ctr := &EngineController{
-		nodeName:      nodeName,
-		forwardNodeIP: forwardNodeIP,
-		queue:         workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
-		routeDriver:   routeDriver,
-		manager:       manager,
-		vpnDriver:     vpnDriver,
+		nodeName:                cfg.NodeName,
+		forwardNodeIP:           cfg.ForwardNodeIP,
+		relaySelector:           relaySelector,
+		dryRun:                  cfg.DryRun,
+		publicIP:                publicIP,
+		publicIPRefreshInterval: cfg.PublicIPRefreshInterval,
+		queue:                   workqueue.NewRateLimitingQueue(newRateLimiter(cfg.SyncRetryBaseDelay, cfg.SyncRetryMaxDelay)),
+		maxRetries:              cfg.SyncMaxRetries,
+		updateBackoff:           cfg.GatewayUpdateBackoff(),
+		resyncPeriod:            cfg.ResyncPeriod,
+		startupJitter:           cfg.StartupJitter,
+		syncTimeout:             cfg.SyncTimeout,
+		syncStuckTimeout:        cfg.SyncStuckTimeout,
+		linkStatsInterval:       cfg.LinkStatsInterval,
+		heartbeat:               newHeartbeater(cfg.HeartbeatPort, cfg.HeartbeatInterval, cfg.HeartbeatTimeout),
+		routeDriver:             routeDriver,
+		manager:                 cfg.Manager,
+		vpnDriver:               vpnDriver,
+		publicIPFailed:          make(map[string]bool),
+		recorder:                cfg.Manager.GetEventRecorderFor("raven-agent"),
+		routeDriverName:         cfg.RouteDriver,
+		vpnDriverName:           cfg.VPNDriver,
 	}
 
 	err := ctrl.NewControllerManagedBy(ctr.manager).
@@ -89,22 +218,184 @@ func NewEngineController(nodeName string, forwardNodeIP bool, routeDriver routed
 	}
 	ctr.ravenClient = ctr.manager.GetClient()
 
+	if err := ctr.manager.AddHealthzCheck("healthz", ctr.LivenessCheck); err != nil {
+		return nil, fmt.Errorf("failed to add healthz check: %s", err)
+	}
+	if err := ctr.manager.AddReadyzCheck("readyz", ctr.ReadyCheck); err != nil {
+		return nil, fmt.Errorf("failed to add readyz check: %s", err)
+	}
+	if err := ctr.addMetricsHandlers(ctr.manager, cfg.MetricsAuthenticated); err != nil {
+		return nil, err
+	}
+
 	return ctr, nil
 }
 
+// metricsHandlerAdder is the part of manager.Manager to serve extra handlers on the metrics endpoint.
+type metricsHandlerAdder interface {
+	AddMetricsExtraHandler(path string, handler http.Handler) error
+}
+
+// addMetricsHandlers adds the status and log handlers to the metrics endpoint. The status shows the peers and
+// the log verbosity changes the agent, raised verbosity may even log the peer configs, so they are not served
+// to anyone reaching the metrics endpoint of the host network.
+func (c *EngineController) addMetricsHandlers(mgr metricsHandlerAdder, authenticated bool) error {
+	if !authenticated {
+		klog.InfoS("metrics endpoint is not authenticated, status and log verbosity handlers are not served")
+		return nil
+	}
+	if err := mgr.AddMetricsExtraHandler(StatusPath, http.HandlerFunc(c.serveStatus)); err != nil {
+		return fmt.Errorf("failed to add status handler: %s", err)
+	}
+	if err := mgr.AddMetricsExtraHandler(LogVerbosityPath, verbosityHandler); err != nil {
+		return fmt.Errorf("failed to add log verbosity handler: %s", err)
+	}
+	if err := mgr.AddMetricsExtraHandler(LogVModulePath, vmoduleHandler); err != nil {
+		return fmt.Errorf("failed to add log vmodule handler: %s", err)
+	}
+	return nil
+}
+
+// newRateLimiter returns a rate limiter like workqueue.DefaultControllerRateLimiter with the given
+// per-item exponential backoff. Zero delays fall back to the defaults.
+func newRateLimiter(baseDelay, maxDelay time.Duration) workqueue.RateLimiter {
+	if baseDelay <= 0 {
+		baseDelay = DefaultSyncRetryBaseDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = DefaultSyncRetryMaxDelay
+	}
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(baseDelay, maxDelay),
+		// 10 qps, 100 bucket size. This is only for retry speed and its only the overall factor (not per item)
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+}
+
 func (c *EngineController) Start(ctx context.Context) {
 	defer utilruntime.HandleCrash()
+	if !c.waitStartupJitter(ctx) {
+		return
+	}
 	go func() {
 		if err := c.manager.Start(ctx); err != nil {
 			klog.ErrorS(err, "failed to start engine controller")
 		}
 	}()
-	go wait.Until(c.worker, time.Second, ctx.Done())
-	klog.Info("engine controller successfully start")
+	// A sync runs on start even without any Gateway event, so that the agent becomes ready.
+	c.queue.Add(resyncKey)
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		wait.UntilWithContext(ctx, c.worker, time.Second)
+	}()
+	if c.publicIPRefreshInterval > 0 {
+		go c.runPublicIPRefresher(ctx)
+	}
+	if c.resyncPeriod > 0 {
+		// Kernel state may drift without any Gateway event, e.g. routes are flushed or SAs expire,
+		// so apply the network periodically to reconverge it.
+		go wait.UntilWithContext(ctx, func(ctx context.Context) {
+			c.queue.Add(resyncKey)
+		}, c.resyncPeriod)
+	}
+	// In dry run the drivers are not initialized, so there are no links to sample.
+	if c.linkStatsInterval > 0 && !c.dryRun {
+		go wait.Until(c.sampleLinkStats, c.linkStatsInterval, ctx.Done())
+	}
+	// In dry run nothing is sent to the remote gateways either.
+	if c.heartbeat != nil && !c.dryRun {
+		go c.heartbeat.run(ctx, c.heartbeatPeers)
+	}
+	klog.InfoS("engine controller successfully start", "node", c.nodeName, "routeDriver", c.routeDriverName, "vpnDriver", c.vpnDriverName)
+}
+
+// waitStartupJitter waits for a random delay up to startupJitter, so that agents started at the same time,
+// e.g. in a cluster-wide rollout, do not hit the API server and public IP APIs all at once.
+// It returns false if ctx is done before the delay passes.
+func (c *EngineController) waitStartupJitter(ctx context.Context) bool {
+	if c.startupJitter <= 0 {
+		return true
+	}
+	delay := time.Duration(rand.Int63n(int64(c.startupJitter)))
+	klog.InfoS("delaying engine controller start", "node", c.nodeName, "delay", delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Shutdown stops accepting new events and waits for the queued and in-flight syncs to finish,
+// or for ctx to be done. The drivers can be cleaned up safely once it returns nil.
+func (c *EngineController) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.queue.ShutDownWithDrain()
+		c.workers.Wait()
+		// wait for the driver call abandoned by a timed out sync, if any.
+		c.driverMutex.Lock()
+		c.driverMutex.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		klog.InfoS("engine controller successfully shutdown", "node", c.nodeName)
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timeout waiting for engine controller to shutdown: %s", ctx.Err())
+	}
+}
+
+// runPublicIPRefresher detects public IP of the local active endpoint every publicIPRefreshInterval,
+// because the public IP may change without any Gateway event, e.g. behind carrier-grade NAT.
+func (c *EngineController) runPublicIPRefresher(ctx context.Context) {
+	ticker := time.NewTicker(c.publicIPRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.refreshPublicIP(ctx)
+		}
+	}
+}
+
+// refreshPublicIP detects public IP of the local active endpoint and updates the gateway if it changed.
+func (c *EngineController) refreshPublicIP(ctx context.Context) {
+	var gws v1alpha1.GatewayList
+	if err := c.ravenClient.List(ctx, &gws); err != nil {
+		klog.ErrorS(err, "error listing gateways")
+		return
+	}
+	for i := range gws.Items {
+		gw := &gws.Items[i]
+		ep := gw.Status.ActiveEndpoint
+		if ep == nil || ep.NodeName != c.nodeName {
+			continue
+		}
+		publicIP, err := c.publicIP.ForceRefreshPublicIP(ctx)
+		c.recordPublicIPResult(gw, err)
+		if err != nil {
+			klog.ErrorS(err, "error refreshing gateway public ip", "gateway", klog.KObj(gw))
+			continue
+		}
+		if publicIP == ep.PublicIP {
+			continue
+		}
+		klog.InfoS("public ip of gateway changed", "gateway", klog.KObj(gw), "old", ep.PublicIP, "new", publicIP)
+		if err := c.updateGatewayPublicIP(ctx, gw.Name, publicIP); err != nil {
+			klog.ErrorS(err, "error updating gateway public ip", "gateway", klog.KObj(gw))
+		}
+	}
 }
 
-func (c *EngineController) worker() {
-	for c.processNextWorkItem() {
+func (c *EngineController) worker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
 	}
 }
 
@@ -112,19 +403,88 @@ func (c *EngineController) enqueue(obj *v1alpha1.Gateway) {
 	c.queue.Add(obj.Name)
 }
 
-func (c *EngineController) processNextWorkItem() bool {
+func (c *EngineController) processNextWorkItem(ctx context.Context) bool {
 	key, quit := c.queue.Get()
 	if quit {
 		return false
 	}
 	defer c.queue.Done(key)
+	reconcileQueueDepth.Set(float64(c.queue.Len()))
 
-	err := c.sync()
+	start := time.Now()
+	if c.syncTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.syncTimeout)
+		defer cancel()
+	}
+	ctx, span := tracer.Start(ctx, "sync", trace.WithAttributes(
+		attribute.String("event", fmt.Sprint(key)),
+		attribute.String("node", c.nodeName),
+	))
+	c.recordSyncStart(start)
+	err := c.sync(ctx, key == resyncKey)
+	endSpan(span, err)
+	observeReconcile(c.routeDriverName, c.vpnDriverName, start, err)
+	c.recordSyncResult(err)
 	c.handleEventErr(err, key)
 
 	return true
 }
 
+func (c *EngineController) recordSyncStart(start time.Time) {
+	c.syncStatusMutex.Lock()
+	defer c.syncStatusMutex.Unlock()
+	c.syncStartTime = start
+}
+
+func (c *EngineController) recordSyncResult(err error) {
+	c.syncStatusMutex.Lock()
+	defer c.syncStatusMutex.Unlock()
+	c.syncStartTime = time.Time{}
+	c.lastSyncErr = err
+	c.lastSyncTime = time.Now()
+	c.appliedNetwork = c.lastSeenNetwork.Copy()
+}
+
+func (c *EngineController) recordDriverCallStart(start time.Time) {
+	c.syncStatusMutex.Lock()
+	defer c.syncStatusMutex.Unlock()
+	c.driverCallStartTime = start
+}
+
+// LivenessCheck reports not alive if a sync or a driver call has been running longer than syncStuckTimeout, e.g. it
+// is blocked by a hung netlink or whack call, so that the agent is restarted instead of silently doing nothing.
+// A driver call abandoned by a timed out sync is still checked, because the drivers can not be called until it returns.
+func (c *EngineController) LivenessCheck(_ *http.Request) error {
+	c.syncStatusMutex.RLock()
+	defer c.syncStatusMutex.RUnlock()
+	if c.syncStuckTimeout <= 0 {
+		return nil
+	}
+	if running := time.Since(c.syncStartTime); !c.syncStartTime.IsZero() && running > c.syncStuckTimeout {
+		return fmt.Errorf("sync started at %s is still running after %s", c.syncStartTime.Format(time.RFC3339), running.Round(time.Second))
+	}
+	if running := time.Since(c.driverCallStartTime); !c.driverCallStartTime.IsZero() && running > c.syncStuckTimeout {
+		return fmt.Errorf("driver call started at %s is still running after %s", c.driverCallStartTime.Format(time.RFC3339),
+			running.Round(time.Second))
+	}
+	return nil
+}
+
+// ReadyCheck reports not ready until a sync succeeded, and if the most recent sync failed.
+// The drivers are always initialized once the engine controller is created.
+func (c *EngineController) ReadyCheck(_ *http.Request) error {
+	c.syncStatusMutex.RLock()
+	defer c.syncStatusMutex.RUnlock()
+	if c.lastSyncTime.IsZero() {
+		return fmt.Errorf("no sync has run yet")
+	}
+	if c.lastSyncErr != nil {
+		return fmt.Errorf("last sync at %s failed: %s", c.lastSyncTime.Format(time.RFC3339), c.lastSyncErr)
+	}
+	return nil
+}
+
 func (c *EngineController) getMergedSubnets(nodeInfo []v1alpha1.NodeInfo) []string {
 	subnets := make([]string, 0)
 	for _, n := range nodeInfo {
@@ -135,9 +495,10 @@ func (c *EngineController) getMergedSubnets(nodeInfo []v1alpha1.NodeInfo) []stri
 }
 
 // sync syncs full state according to the gateway list.
-func (c *EngineController) sync() error {
+// The network is applied to the drivers only if it is changed, unless force is true.
+func (c *EngineController) sync(ctx context.Context, force bool) error {
 	var gws v1alpha1.GatewayList
-	err := c.ravenClient.List(context.Background(), &gws)
+	err := c.ravenClient.List(ctx, &gws)
 	if err != nil {
 		return err
 	}
@@ -150,11 +511,15 @@ func (c *EngineController) sync() error {
 	}
 	c.nodeInfos = make(map[types.NodeName]*v1alpha1.NodeInfo)
 
+	validGws := make([]*v1alpha1.Gateway, 0, len(gws.Items))
+	drainedGws := make([]*v1alpha1.Gateway, 0)
 	for i := range gws.Items {
 		// try to update public IP if empty.
 		gw := &gws.Items[i]
 		if ep := gw.Status.ActiveEndpoint; ep != nil && ep.PublicIP == "" {
-			err := c.configGatewayPublicIP(gw)
+			spanCtx, span := tracer.Start(ctx, "configGatewayPublicIP", trace.WithAttributes(attribute.String("gateway", gw.Name)))
+			err := c.configGatewayPublicIP(spanCtx, gw)
+			endSpan(span, err)
 			if err != nil {
 				klog.ErrorS(err, "error config gateway public ip", "gateway", klog.KObj(gw))
 			}
@@ -163,35 +528,144 @@ func (c *EngineController) sync() error {
 		if !c.shouldHandleGateway(gw) {
 			continue
 		}
+		if err := validateGateway(gw); err != nil {
+			c.recordInvalidGateway(gw, err)
+			continue
+		}
+		if gw.Annotations[DrainAnnotation] == "true" {
+			c.recordDrainStarted(gw)
+			drainedGws = append(drainedGws, gw)
+			continue
+		}
 		c.syncNodeInfo(gw.Status.Nodes)
+		validGws = append(validGws, gw)
 	}
+	natTypes := make(map[string]string, len(gws.Items))
 	for i := range gws.Items {
-		gw := &gws.Items[i]
-		if !c.shouldHandleGateway(gw) {
-			continue
+		// the gateways skipped in this sync, e.g. drained ones, keep their NAT type, so that a change while
+		// they are skipped is recorded once they are valid again.
+		if natType, ok := c.natTypes[gws.Items[i].Name]; ok {
+			natTypes[gws.Items[i].Name] = natType
 		}
-		c.syncGateway(gw)
 	}
-	if reflect.DeepEqual(c.network, c.lastSeenNetwork) {
-		klog.Info("network not changed, skip to process")
+	for _, gw := range validGws {
+		c.syncGateway(ctx, gw)
+		natTypes[gw.Name] = c.recordNATType(gw)
+	}
+	c.natTypes = natTypes
+	observeNATTypes(c.network)
+	if !force && reflect.DeepEqual(c.network, c.lastSeenNetwork) {
+		klog.InfoS("network not changed, skip to process", "node", c.nodeName)
+		c.recordDrainCompleted(drainedGws)
 		return nil
 	}
 	nw := c.network.Copy()
-	klog.InfoS("applying network", "localEndpoint", nw.LocalEndpoint, "remoteEndpoint", nw.RemoteEndpoints)
-	err = c.vpnDriver.Apply(nw, c.routeDriver.MTU)
+	if c.dryRun {
+		logNetworkPlan(nw)
+		c.lastSeenNetwork = c.network
+		c.recordDrainCompleted(drainedGws)
+		return nil
+	}
+	klog.InfoS("applying network", "node", c.nodeName, "localEndpoint", nw.LocalEndpoint, "remoteEndpoint", nw.RemoteEndpoints,
+		"routeDriver", c.routeDriverName, "vpnDriver", c.vpnDriverName)
+	// The vpn driver applies each connection independently and returns the errors of the failed ones,
+	// so the route driver is still applied to keep the healthy connections routed.
+	errList := errorlist.List{}
+	_, span := tracer.Start(ctx, "vpnDriver.Apply", trace.WithAttributes(attribute.String("vpnDriver", c.vpnDriverName)))
+	err = c.callDriver(ctx, "vpnDriver.Apply", func() error {
+		return c.vpnDriver.Apply(nw, c.routeDriver.MTU)
+	})
+	endSpan(span, err)
 	if err != nil {
-		return err
+		klog.ErrorS(err, "error applying network with vpn driver", "node", c.nodeName, "vpnDriver", c.vpnDriverName)
+		errList = errList.Append(fmt.Errorf("error applying network with vpn driver: %w", err))
 	}
-	err = c.routeDriver.Apply(nw, c.vpnDriver.MTU)
+	_, span = tracer.Start(ctx, "routeDriver.Apply", trace.WithAttributes(attribute.String("routeDriver", c.routeDriverName)))
+	err = c.callDriver(ctx, "routeDriver.Apply", func() error {
+		return c.routeDriver.Apply(nw, c.vpnDriver.MTU)
+	})
+	endSpan(span, err)
 	if err != nil {
+		klog.ErrorS(err, "error applying network with route driver", "node", c.nodeName, "routeDriver", c.routeDriverName)
+		errList = errList.Append(fmt.Errorf("error applying network with route driver: %w", err))
+	}
+	if err := errList.AsError(); err != nil {
 		return err
 	}
 
 	// Only update lastSeenNetwork when all operations succeeded.
 	c.lastSeenNetwork = c.network
+	c.recordDrainCompleted(drainedGws)
 	return nil
 }
 
+// callDriver runs the driver call fn, and abandons it once ctx is done, e.g. the sync times out.
+// The drivers take no context, so an abandoned call keeps running in the background, and the following driver
+// calls fail immediately until it returns, instead of running concurrently with it.
+func (c *EngineController) callDriver(ctx context.Context, name string, fn func() error) error {
+	if !c.driverMutex.TryLock() {
+		return fmt.Errorf("%s is skipped, an abandoned driver call is still running", name)
+	}
+	c.recordDriverCallStart(time.Now())
+	done := make(chan error, 1)
+	go func() {
+		defer c.driverMutex.Unlock()
+		defer c.recordDriverCallStart(time.Time{})
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		klog.ErrorS(ctx.Err(), "abandoning driver call", "call", name, "node", c.nodeName)
+		return fmt.Errorf("%s is abandoned: %s", name, ctx.Err())
+	}
+}
+
+// resolvePublicDNSName returns the IPv4 address the DNS name of the gateway resolves to,
+// or the given public IP if it can not be resolved. A round-robin name resolves to the addresses in any order,
+// so the applied IP is kept while it is still resolved, otherwise the lowest address is picked,
+// instead of changing the network and applying it again on every sync.
+func resolvePublicDNSName(ctx context.Context, gw *v1alpha1.Gateway, name, publicIP, appliedIP string) string {
+	ips, err := lookupIP(ctx, name)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("no ipv4 address found")
+	}
+	if err != nil {
+		klog.ErrorS(err, "error resolving public dns name of gateway, using its public ip", "gateway", klog.KObj(gw),
+			"name", name, "publicIP", publicIP)
+		return publicIP
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+	ip := ips[0].String()
+	for _, v := range ips {
+		if v.String() == appliedIP {
+			ip = appliedIP
+			break
+		}
+	}
+	klog.V(4).InfoS("resolved public dns name of gateway", "gateway", klog.KObj(gw), "name", name, "ip", ip)
+	return ip
+}
+
+// logNetworkPlan logs the desired network that would be applied by the route driver and vpn driver.
+func logNetworkPlan(nw *types.Network) {
+	logEndpoint := func(msg string, ep *types.Endpoint) {
+		klog.InfoS(msg, "gateway", ep.GatewayName, "node", ep.NodeName, "privateIP", ep.PrivateIP,
+			"publicIP", ep.PublicIP, "underNAT", ep.UnderNAT, "subnets", ep.Subnets)
+	}
+	klog.InfoS("dry run, skip applying network", "remoteEndpoints", len(nw.RemoteEndpoints),
+		"localNodes", len(nw.LocalNodeInfo), "remoteNodes", len(nw.RemoteNodeInfo))
+	if nw.LocalEndpoint != nil {
+		logEndpoint("dry run, local endpoint", nw.LocalEndpoint)
+	}
+	for _, ep := range nw.RemoteEndpoints {
+		logEndpoint("dry run, remote endpoint", ep)
+	}
+}
+
 func (c *EngineController) syncNodeInfo(nodes []v1alpha1.NodeInfo) {
 	for _, v := range nodes {
 		c.nodeInfos[types.NodeName(v.NodeName)] = v.DeepCopy()
@@ -208,7 +682,7 @@ func (c *EngineController) appendNodeIP(gw *v1alpha1.Gateway) {
 	}
 }
 
-func (c *EngineController) syncGateway(gw *v1alpha1.Gateway) {
+func (c *EngineController) syncGateway(ctx context.Context, gw *v1alpha1.Gateway) {
 	if c.forwardNodeIP {
 		c.appendNodeIP(gw)
 	}
@@ -220,7 +694,7 @@ func (c *EngineController) syncGateway(gw *v1alpha1.Gateway) {
 	}
 	var nodeInfo *v1alpha1.NodeInfo
 	if nodeInfo = c.nodeInfos[types.NodeName(aep.NodeName)]; nodeInfo == nil {
-		klog.Errorf("node %s is found in Endpoint but not existed in NodeInfo", aep.NodeName)
+		klog.ErrorS(nil, "node is found in Endpoint but not existed in NodeInfo", "gateway", klog.KObj(gw), "node", aep.NodeName)
 		return
 	}
 	ep := &types.Endpoint{
@@ -231,6 +705,10 @@ func (c *EngineController) syncGateway(gw *v1alpha1.Gateway) {
 		PublicIP:    aep.PublicIP,
 		UnderNAT:    aep.UnderNAT,
 		Config:      cfg,
+		Relay:       c.relaySelector != nil && c.relaySelector.Matches(labels.Set(gw.Labels)),
+	}
+	if name := cfg[PublicDNSNameKey]; name != "" {
+		ep.PublicIP = resolvePublicDNSName(ctx, gw, name, ep.PublicIP, c.appliedPublicIP(ep.GatewayName))
 	}
 	var isLocalGateway bool
 	defer func() {
@@ -252,19 +730,51 @@ func (c *EngineController) syncGateway(gw *v1alpha1.Gateway) {
 	c.network.RemoteEndpoints[types.GatewayName(gw.Name)] = ep
 }
 
+// appliedPublicIP returns the public IP of the gateway in the network last applied by the drivers.
+func (c *EngineController) appliedPublicIP(name types.GatewayName) string {
+	nw := c.lastSeenNetwork
+	if nw == nil {
+		return ""
+	}
+	if nw.LocalEndpoint != nil && nw.LocalEndpoint.GatewayName == name {
+		return nw.LocalEndpoint.PublicIP
+	}
+	if ep := nw.RemoteEndpoints[name]; ep != nil {
+		return ep.PublicIP
+	}
+	return ""
+}
+
+// handleEventErr retries the failed event with the exponential backoff of the rate limiter, until it has been
+// retried maxRetries times. The dropped event is not lost for good, because any later event of any gateway
+// triggers a full sync again, and a successful sync forgets the failures of the event.
 func (c *EngineController) handleEventErr(err error, event interface{}) {
 	if err == nil {
+		if suppressed := c.syncErrorLogs.forget(event); suppressed > 0 {
+			klog.InfoS("event synced after failures", "event", event, "node", c.nodeName, "suppressedErrors", suppressed)
+		}
 		c.queue.Forget(event)
 		return
 	}
-	if c.queue.NumRequeues(event) < maxRetries {
-		klog.Infof("error syncing event %v: %v", event, err)
+	// Retrying does not help until the Gateways are changed, which enqueues the event again.
+	if utils.IsPermanentError(err) {
+		klog.ErrorS(err, "dropping event out of the queue because of a permanent error", "event", event, "node", c.nodeName,
+			"suppressedErrors", c.syncErrorLogs.forget(event))
+		c.queue.Forget(event)
+		return
+	}
+	if c.queue.NumRequeues(event) < c.maxRetries {
+		if ok, suppressed := c.syncErrorLogs.shouldLog(event, err); ok {
+			klog.ErrorS(err, "error syncing event", "event", event, "node", c.nodeName,
+				"retries", c.queue.NumRequeues(event), "suppressedErrors", suppressed)
+		}
 		c.queue.AddRateLimited(event)
 		return
 	}
 
 	utilruntime.HandleError(err)
-	klog.Infof("dropping event %q out of the queue: %v", event, err)
+	klog.ErrorS(err, "dropping event out of the queue", "event", event, "node", c.nodeName,
+		"suppressedErrors", c.syncErrorLogs.forget(event))
 	c.queue.Forget(event)
 }
 
@@ -280,22 +790,116 @@ func (c *EngineController) shouldHandleGateway(gateway *v1alpha1.Gateway) bool {
 	return true
 }
 
-func (c *EngineController) configGatewayPublicIP(gateway *v1alpha1.Gateway) error {
+// recordNATType returns the NAT type of the active endpoint of the gateway, and records it if it changed since
+// the last sync. Only the agent on the node of the active endpoint emits the event.
+func (c *EngineController) recordNATType(gateway *v1alpha1.Gateway) string {
+	natType := natTypePublic
+	if gateway.Status.ActiveEndpoint.UnderNAT {
+		natType = natTypeNAT
+	}
+	old, ok := c.natTypes[gateway.Name]
+	if !ok || old == natType {
+		return natType
+	}
+	klog.InfoS("nat type of gateway changed", "gateway", klog.KObj(gateway), "old", old, "new", natType)
+	gatewayNATTypeChangesTotal.WithLabelValues(gateway.Name).Inc()
+	if gateway.Status.ActiveEndpoint.NodeName == c.nodeName {
+		// moving out of NAT is a recovery, only moving behind it is worth a warning.
+		eventType := corev1.EventTypeNormal
+		if natType == natTypeNAT {
+			eventType = corev1.EventTypeWarning
+		}
+		c.recorder.Eventf(gateway, eventType, EventNATTypeChanged, "nat type changed from %s to %s", old, natType)
+	}
+	return natType
+}
+
+// recordDrainStarted records the gateway drained by DrainAnnotation the first time it is seen.
+// Only the agent on the node of the active endpoint emits the event.
+func (c *EngineController) recordDrainStarted(gateway *v1alpha1.Gateway) {
+	if _, ok := c.drainedGateways[gateway.Name]; ok {
+		return
+	}
+	if c.drainedGateways == nil {
+		c.drainedGateways = make(map[string]bool)
+	}
+	c.drainedGateways[gateway.Name] = false
+	klog.InfoS("draining gateway", "gateway", klog.KObj(gateway))
+	if gateway.Status.ActiveEndpoint.NodeName == c.nodeName {
+		c.recorder.Event(gateway, corev1.EventTypeNormal, EventGatewayDrainStarted, "withdrawing gateway from the network")
+	}
+}
+
+// recordDrainCompleted records the drained gateways once the network without them is applied,
+// and forgets the gateways that are not drained anymore.
+func (c *EngineController) recordDrainCompleted(drained []*v1alpha1.Gateway) {
+	names := make(map[string]struct{}, len(drained))
+	for _, gw := range drained {
+		names[gw.Name] = struct{}{}
+		if c.drainedGateways[gw.Name] {
+			continue
+		}
+		c.drainedGateways[gw.Name] = true
+		klog.InfoS("gateway drained", "gateway", klog.KObj(gw))
+		if gw.Status.ActiveEndpoint.NodeName == c.nodeName {
+			c.recorder.Event(gw, corev1.EventTypeNormal, EventGatewayDrainCompleted, "gateway is withdrawn from the network")
+		}
+	}
+	for name := range c.drainedGateways {
+		if _, ok := names[name]; !ok {
+			klog.InfoS("gateway is not drained anymore", "gateway", name)
+			delete(c.drainedGateways, name)
+		}
+	}
+}
+
+// recordInvalidGateway logs the malformed gateway that is skipped. Only the agent on the node of the active endpoint
+// emits the event, to avoid every agent emitting the same event.
+func (c *EngineController) recordInvalidGateway(gateway *v1alpha1.Gateway, err error) {
+	klog.ErrorS(err, "invalid gateway, skip to process", "gateway", klog.KObj(gateway))
+	if gateway.Status.ActiveEndpoint.NodeName == c.nodeName {
+		c.recorder.Eventf(gateway, corev1.EventTypeWarning, EventInvalidGateway, "gateway is skipped: %v", err)
+	}
+}
+
+func (c *EngineController) configGatewayPublicIP(ctx context.Context, gateway *v1alpha1.Gateway) error {
 	if gateway.Status.ActiveEndpoint.NodeName != c.nodeName {
 		return nil
 	}
 
-	publicIP, err := utils.GetPublicIP()
+	publicIP, err := c.publicIP.GetPublicIP(ctx)
+	c.recordPublicIPResult(gateway, err)
 	if err != nil {
 		return err
 	}
+	return c.updateGatewayPublicIP(ctx, gateway.Name, publicIP)
+}
+
+// recordPublicIPResult emits an event on the gateway when public IP detection fails,
+// or when it succeeds after previous failures.
+func (c *EngineController) recordPublicIPResult(gateway *v1alpha1.Gateway, err error) {
+	c.publicIPFailedMutex.Lock()
+	defer c.publicIPFailedMutex.Unlock()
+	if err != nil {
+		c.publicIPFailed[gateway.Name] = true
+		c.recorder.Eventf(gateway, corev1.EventTypeWarning, EventPublicIPDetectionFailed,
+			"failed to detect public ip of node %s: %v", c.nodeName, err)
+		return
+	}
+	if c.publicIPFailed[gateway.Name] {
+		delete(c.publicIPFailed, gateway.Name)
+		c.recorder.Eventf(gateway, corev1.EventTypeNormal, EventPublicIPDetected,
+			"public ip of node %s is detected", c.nodeName)
+	}
+}
 
+func (c *EngineController) updateGatewayPublicIP(ctx context.Context, gwName string, publicIP string) error {
 	// retry to update public ip of localGateway
-	err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+	err := retry.RetryOnConflict(c.updateBackoff, func() error {
 		// get localGateway from api server
 		var apiGw v1alpha1.Gateway
-		err := c.ravenClient.Get(context.Background(), client.ObjectKey{
-			Name: gateway.Name,
+		err := c.ravenClient.Get(ctx, client.ObjectKey{
+			Name: gwName,
 		}, &apiGw)
 		if err != nil {
 			return err
@@ -303,7 +907,7 @@ func (c *EngineController) configGatewayPublicIP(gateway *v1alpha1.Gateway) erro
 		for k, v := range apiGw.Spec.Endpoints {
 			if v.NodeName == c.nodeName {
 				apiGw.Spec.Endpoints[k].PublicIP = publicIP
-				err = c.ravenClient.Update(context.Background(), &apiGw)
+				err = c.ravenClient.Update(ctx, &apiGw)
 				return err
 			}
 		}
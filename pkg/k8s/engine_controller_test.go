@@ -0,0 +1,646 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/openyurtio/openyurt/pkg/apis/raven/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/openyurtio/raven/cmd/agent/app/config"
+	enginetesting "github.com/openyurtio/raven/pkg/networkengine/testing"
+	"github.com/openyurtio/raven/pkg/types"
+	"github.com/openyurtio/raven/pkg/utils"
+)
+
+func TestEngineController_ReadyCheck(t *testing.T) {
+	a := assert.New(t)
+	c := &EngineController{}
+	err := c.ReadyCheck(nil)
+	a.Error(err, "should not be ready before the first sync")
+	a.Contains(err.Error(), "no sync has run yet")
+
+	c.recordSyncResult(errors.New("apply failed"))
+	err = c.ReadyCheck(nil)
+	a.Error(err)
+	a.Contains(err.Error(), "apply failed")
+
+	c.recordSyncResult(nil)
+	a.NoError(c.ReadyCheck(nil))
+}
+
+func TestEngineController_LivenessCheck(t *testing.T) {
+	a := assert.New(t)
+	c := &EngineController{syncStuckTimeout: time.Minute}
+	a.NoError(c.LivenessCheck(nil), "should be alive if no sync is running")
+
+	c.recordSyncStart(time.Now())
+	a.NoError(c.LivenessCheck(nil), "should be alive while a sync runs within the timeout")
+
+	c.recordSyncStart(time.Now().Add(-2 * time.Minute))
+	err := c.LivenessCheck(nil)
+	a.Error(err)
+	a.Contains(err.Error(), "still running")
+
+	c.recordSyncResult(nil)
+	a.NoError(c.LivenessCheck(nil), "should be alive once the sync finished")
+
+	c.syncStuckTimeout = 0
+	c.recordSyncStart(time.Now().Add(-2 * time.Minute))
+	a.NoError(c.LivenessCheck(nil), "should always be alive if disabled")
+}
+
+func TestEngineController_ReconcileErrorMetric(t *testing.T) {
+	a := assert.New(t)
+	c := &EngineController{
+		// the Gateway type is not registered, so listing gateways always fails.
+		ravenClient:     fake.NewClientBuilder().WithScheme(runtime.NewScheme()).Build(),
+		queue:           workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		routeDriverName: "fake-route",
+		vpnDriverName:   "fake-vpn",
+	}
+	defer c.queue.ShutDown()
+	before := testutil.ToFloat64(reconcileErrorsTotal.WithLabelValues("fake-route", "fake-vpn"))
+
+	c.queue.Add("gw")
+	a.True(c.processNextWorkItem(context.Background()))
+	a.Equal(before+1, testutil.ToFloat64(reconcileErrorsTotal.WithLabelValues("fake-route", "fake-vpn")))
+	a.Error(c.ReadyCheck(nil))
+}
+
+func TestEngineController_HandleEventErr(t *testing.T) {
+	a := assert.New(t)
+	c := &EngineController{
+		queue:      workqueue.NewRateLimitingQueue(newRateLimiter(time.Millisecond, 4*time.Millisecond)),
+		maxRetries: 3,
+	}
+	defer c.queue.ShutDown()
+
+	for i := 0; i < 3; i++ {
+		c.handleEventErr(errors.New("sync failed"), "gw")
+		a.Equal(i+1, c.queue.NumRequeues("gw"))
+	}
+	// the event is dropped once it has been retried maxRetries times.
+	c.handleEventErr(errors.New("sync failed"), "gw")
+	a.Equal(0, c.queue.NumRequeues("gw"))
+
+	// the event is dropped without retrying if the error is permanent.
+	c.handleEventErr(utils.NewPermanentError(errors.New("overlapping subnets")), "gw2")
+	a.Equal(0, c.queue.NumRequeues("gw2"))
+}
+
+func TestEngineController_SyncPermanentError(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	vpnErr := utils.NewPermanentError(errors.New("overlapping subnets"))
+	c := &EngineController{
+		ravenClient: fake.NewClientBuilder().WithScheme(scheme).Build(),
+		routeDriver: &enginetesting.RouteDriver{},
+		vpnDriver:   &enginetesting.VPNDriver{Driver: enginetesting.Driver{ApplyErr: vpnErr}},
+	}
+	a.True(utils.IsPermanentError(c.sync(context.Background(), false)))
+
+	// a transient error of the other driver makes the sync retried.
+	c.routeDriver = &enginetesting.RouteDriver{Driver: enginetesting.Driver{ApplyErr: errors.New("netlink failed")}}
+	a.False(utils.IsPermanentError(c.sync(context.Background(), false)))
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	a := assert.New(t)
+	limiter := newRateLimiter(time.Millisecond, 4*time.Millisecond)
+	a.Equal(time.Millisecond, limiter.When("gw"))
+	a.Equal(2*time.Millisecond, limiter.When("gw"))
+	a.Equal(4*time.Millisecond, limiter.When("gw"))
+	a.Equal(4*time.Millisecond, limiter.When("gw"), "delay should be capped by max delay")
+
+	limiter = newRateLimiter(0, 0)
+	a.Equal(DefaultSyncRetryBaseDelay, limiter.When("gw"))
+}
+
+func TestEngineController_Shutdown(t *testing.T) {
+	a := assert.New(t)
+	c := &EngineController{
+		// the Gateway type is not registered, so listing gateways always fails.
+		ravenClient: fake.NewClientBuilder().WithScheme(runtime.NewScheme()).Build(),
+		queue:       workqueue.NewRateLimitingQueue(newRateLimiter(time.Millisecond, time.Millisecond)),
+		maxRetries:  DefaultSyncMaxRetries,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		c.worker(ctx)
+	}()
+	c.queue.Add("gw")
+	cancel()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	a.NoError(c.Shutdown(shutdownCtx))
+	a.Equal(0, c.queue.Len())
+}
+
+func TestEngineController_ForceSync(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	routeDriver := &enginetesting.RouteDriver{}
+	vpnDriver := &enginetesting.VPNDriver{}
+	c := &EngineController{
+		ravenClient: fake.NewClientBuilder().WithScheme(scheme).Build(),
+		routeDriver: routeDriver,
+		vpnDriver:   vpnDriver,
+	}
+
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal(1, routeDriver.ApplyCalls())
+	a.Equal(1, vpnDriver.ApplyCalls())
+	a.Equal(vpnDriver.LastApplied(), routeDriver.LastApplied(), "both drivers should apply the same network")
+
+	// the network is not changed, so it is not applied again.
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal(1, routeDriver.ApplyCalls())
+	a.Equal(1, vpnDriver.ApplyCalls())
+
+	// resync applies the network even if it is not changed.
+	a.NoError(c.sync(context.Background(), true))
+	a.Equal(2, routeDriver.ApplyCalls())
+	a.Equal(2, vpnDriver.ApplyCalls())
+}
+
+func TestEngineController_ServeStatus(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	c := &EngineController{
+		nodeName:        "node-1",
+		ravenClient:     fake.NewClientBuilder().WithScheme(scheme).Build(),
+		routeDriver:     &enginetesting.RouteDriver{},
+		vpnDriver:       &enginetesting.VPNDriver{},
+		routeDriverName: "fake-route",
+		vpnDriverName:   "fake-vpn",
+	}
+	a.Nil(c.Snapshot().Network, "no network is applied before the first sync")
+
+	c.recordSyncResult(c.sync(context.Background(), false))
+	rec := httptest.NewRecorder()
+	c.serveStatus(rec, httptest.NewRequest(http.MethodGet, StatusPath, nil))
+	a.Equal(http.StatusOK, rec.Code)
+
+	var status Status
+	a.NoError(json.Unmarshal(rec.Body.Bytes(), &status))
+	a.Equal("node-1", status.NodeName)
+	a.Equal("fake-route", status.RouteDriver)
+	a.Equal("fake-vpn", status.VPNDriver)
+	a.Empty(status.LastSyncError)
+	a.NotNil(status.Network)
+}
+
+type fakeMetricsServer map[string]http.Handler
+
+func (s fakeMetricsServer) AddMetricsExtraHandler(path string, handler http.Handler) error {
+	s[path] = handler
+	return nil
+}
+
+func TestEngineController_AddMetricsHandlers(t *testing.T) {
+	a := assert.New(t)
+	c := &EngineController{}
+
+	unauthenticated := fakeMetricsServer{}
+	a.NoError(c.addMetricsHandlers(unauthenticated, false))
+	a.Empty(unauthenticated, "status and log handlers should not be served without authentication")
+
+	authenticated := fakeMetricsServer{}
+	a.NoError(c.addMetricsHandlers(authenticated, true))
+	a.Contains(authenticated, StatusPath)
+	a.Contains(authenticated, LogVerbosityPath)
+	a.Contains(authenticated, LogVModulePath)
+}
+
+func TestEngineController_WaitStartupJitter(t *testing.T) {
+	a := assert.New(t)
+	c := &EngineController{}
+	a.True(c.waitStartupJitter(context.Background()), "no delay if jitter is disabled")
+
+	c.startupJitter = time.Millisecond
+	a.True(c.waitStartupJitter(context.Background()))
+
+	c.startupJitter = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	a.False(c.waitStartupJitter(ctx), "should stop waiting once ctx is done")
+}
+
+func TestEngineController_SyncVPNDriverError(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	routeDriver := &enginetesting.RouteDriver{}
+	vpnDriver := &enginetesting.VPNDriver{Driver: enginetesting.Driver{ApplyErr: errors.New("connection failed")}}
+	c := &EngineController{
+		ravenClient: fake.NewClientBuilder().WithScheme(scheme).Build(),
+		routeDriver: routeDriver,
+		vpnDriver:   vpnDriver,
+	}
+
+	err := c.sync(context.Background(), false)
+	a.Error(err)
+	a.Contains(err.Error(), "connection failed")
+	a.Equal(1, routeDriver.ApplyCalls(), "route driver should be applied even if some connections failed")
+
+	// the failed network is applied again on the next sync.
+	vpnDriver.ApplyErr = nil
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal(2, routeDriver.ApplyCalls())
+	a.Equal(2, vpnDriver.ApplyCalls())
+}
+
+func TestEngineController_SyncNoActiveEndpoint(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	// the gateway controller has not elected an active endpoint yet.
+	gw := &v1alpha1.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Name: "gw"},
+		Spec: v1alpha1.GatewaySpec{
+			Endpoints: []v1alpha1.Endpoint{{NodeName: "node"}},
+		},
+		Status: v1alpha1.GatewayStatus{
+			Nodes: []v1alpha1.NodeInfo{{NodeName: "node", PrivateIP: "192.168.0.1", Subnets: []string{"10.244.0.0/24"}}},
+		},
+	}
+	routeDriver := &enginetesting.RouteDriver{}
+	vpnDriver := &enginetesting.VPNDriver{}
+	c := &EngineController{
+		nodeName:    "node",
+		ravenClient: fake.NewClientBuilder().WithScheme(scheme).WithObjects(gw).Build(),
+		routeDriver: routeDriver,
+		vpnDriver:   vpnDriver,
+	}
+
+	a.NotPanics(func() { a.NoError(c.sync(context.Background(), false)) })
+	a.Nil(vpnDriver.LastApplied().LocalEndpoint, "gateway without active endpoint should be skipped")
+	a.Empty(vpnDriver.LastApplied().RemoteEndpoints)
+	a.Empty(c.nodeInfos)
+}
+
+func TestEngineController_RecordNATType(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	gw := &v1alpha1.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Name: "gw-nat"},
+		Status: v1alpha1.GatewayStatus{
+			Nodes:          []v1alpha1.NodeInfo{{NodeName: "node", PrivateIP: "192.168.0.1", Subnets: []string{"10.244.0.0/24"}}},
+			ActiveEndpoint: &v1alpha1.Endpoint{NodeName: "node", PublicIP: "1.1.1.1"},
+		},
+	}
+	recorder := record.NewFakeRecorder(10)
+	c := &EngineController{
+		nodeName:    "node",
+		ravenClient: fake.NewClientBuilder().WithScheme(scheme).WithObjects(gw).Build(),
+		routeDriver: &enginetesting.RouteDriver{},
+		vpnDriver:   &enginetesting.VPNDriver{},
+		recorder:    recorder,
+	}
+	changes := func() float64 {
+		return testutil.ToFloat64(gatewayNATTypeChangesTotal.WithLabelValues("gw-nat"))
+	}
+
+	// the first detection is not a change.
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal(float64(0), changes())
+	a.Empty(recorder.Events)
+
+	gw.Status.ActiveEndpoint.UnderNAT = true
+	a.NoError(c.ravenClient.Update(context.Background(), gw))
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal(float64(1), changes())
+	a.Equal("Warning NATTypeChanged nat type changed from public to nat", <-recorder.Events)
+
+	// the same nat type is not a change.
+	a.NoError(c.sync(context.Background(), true))
+	a.Equal(float64(1), changes())
+	a.Empty(recorder.Events)
+
+	// moving out of NAT while drained is recorded once the gateway is restored.
+	gw.Annotations = map[string]string{DrainAnnotation: "true"}
+	a.NoError(c.ravenClient.Update(context.Background(), gw))
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal("Normal GatewayDrainStarted withdrawing gateway from the network", <-recorder.Events)
+	a.Equal("Normal GatewayDrainCompleted gateway is withdrawn from the network", <-recorder.Events)
+	gw.Annotations = nil
+	gw.Status.ActiveEndpoint.UnderNAT = false
+	a.NoError(c.ravenClient.Update(context.Background(), gw))
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal(float64(2), changes())
+	a.Equal("Normal NATTypeChanged nat type changed from nat to public", <-recorder.Events)
+}
+
+func TestEngineController_SyncRelaySelector(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	gateway := func(name string, labels map[string]string, subnet, privateIP string) *v1alpha1.Gateway {
+		node := "node-" + name
+		return &v1alpha1.Gateway{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+			Status: v1alpha1.GatewayStatus{
+				Nodes:          []v1alpha1.NodeInfo{{NodeName: node, PrivateIP: privateIP, Subnets: []string{subnet}}},
+				ActiveEndpoint: &v1alpha1.Endpoint{NodeName: node, PublicIP: "1.1.1.1"},
+			},
+		}
+	}
+	relay := gateway("relay", map[string]string{"raven.openyurt.io/relay": "true"}, "10.244.1.0/24", "192.168.0.1")
+	other := gateway("other", nil, "10.244.2.0/24", "192.168.0.2")
+	selector, err := labels.Parse("raven.openyurt.io/relay=true")
+	a.NoError(err)
+	vpnDriver := &enginetesting.VPNDriver{}
+	c := &EngineController{
+		nodeName:      "node-local",
+		relaySelector: selector,
+		ravenClient:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(relay, other).Build(),
+		routeDriver:   &enginetesting.RouteDriver{},
+		vpnDriver:     vpnDriver,
+	}
+
+	a.NoError(c.sync(context.Background(), false))
+	a.True(vpnDriver.LastApplied().RemoteEndpoints["relay"].Relay)
+	a.False(vpnDriver.LastApplied().RemoteEndpoints["other"].Relay)
+
+	// the relays are selected again once the labels change.
+	relay.Labels = nil
+	a.NoError(c.ravenClient.Update(context.Background(), relay))
+	a.NoError(c.sync(context.Background(), false))
+	a.False(vpnDriver.LastApplied().RemoteEndpoints["relay"].Relay)
+}
+
+func TestEngineController_SyncDrainedGateway(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	gw := &v1alpha1.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Name: "gw", Annotations: map[string]string{DrainAnnotation: "true"}},
+		Status: v1alpha1.GatewayStatus{
+			Nodes:          []v1alpha1.NodeInfo{{NodeName: "node", PrivateIP: "192.168.0.1", Subnets: []string{"10.244.0.0/24"}}},
+			ActiveEndpoint: &v1alpha1.Endpoint{NodeName: "node", PublicIP: "1.1.1.1"},
+		},
+	}
+	recorder := record.NewFakeRecorder(10)
+	vpnDriver := &enginetesting.VPNDriver{}
+	c := &EngineController{
+		nodeName:    "node",
+		ravenClient: fake.NewClientBuilder().WithScheme(scheme).WithObjects(gw).Build(),
+		routeDriver: &enginetesting.RouteDriver{},
+		vpnDriver:   vpnDriver,
+		recorder:    recorder,
+	}
+
+	a.NoError(c.sync(context.Background(), false))
+	a.Nil(vpnDriver.LastApplied().LocalEndpoint, "drained gateway should be withdrawn")
+	a.Empty(vpnDriver.LastApplied().LocalNodeInfo)
+	a.Equal("Normal GatewayDrainStarted withdrawing gateway from the network", <-recorder.Events)
+	a.Equal("Normal GatewayDrainCompleted gateway is withdrawn from the network", <-recorder.Events)
+
+	// the events are emitted only once.
+	a.NoError(c.sync(context.Background(), true))
+	a.Empty(recorder.Events)
+
+	// removing the annotation restores the gateway.
+	gw.Annotations = nil
+	a.NoError(c.ravenClient.Update(context.Background(), gw))
+	a.NoError(c.sync(context.Background(), false))
+	a.NotNil(vpnDriver.LastApplied().LocalEndpoint)
+	a.Empty(c.drainedGateways)
+}
+
+func TestEngineController_SyncPublicDNSName(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	gw := &v1alpha1.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Name: "gw"},
+		Status: v1alpha1.GatewayStatus{
+			Nodes: []v1alpha1.NodeInfo{{NodeName: "node", PrivateIP: "192.168.0.1", Subnets: []string{"10.244.0.0/24"}}},
+			ActiveEndpoint: &v1alpha1.Endpoint{
+				NodeName: "node",
+				PublicIP: "1.1.1.1",
+				Config:   map[string]string{PublicDNSNameKey: "gw.example.com"},
+			},
+		},
+	}
+	defer func(fn func(context.Context, string) ([]net.IP, error)) { lookupIP = fn }(lookupIP)
+	resolved := []net.IP{net.ParseIP("2.2.2.2")}
+	var lookupErr error
+	lookupIP = func(_ context.Context, host string) ([]net.IP, error) {
+		a.Equal("gw.example.com", host)
+		return resolved, lookupErr
+	}
+	vpnDriver := &enginetesting.VPNDriver{}
+	c := &EngineController{
+		nodeName:    "remote-node",
+		ravenClient: fake.NewClientBuilder().WithScheme(scheme).WithObjects(gw).Build(),
+		routeDriver: &enginetesting.RouteDriver{},
+		vpnDriver:   vpnDriver,
+	}
+
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal("2.2.2.2", vpnDriver.LastApplied().RemoteEndpoints["gw"].PublicIP)
+
+	// the name is resolved again on every sync, so that peers follow a changed public ip.
+	resolved = []net.IP{net.ParseIP("3.3.3.3")}
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal("3.3.3.3", vpnDriver.LastApplied().RemoteEndpoints["gw"].PublicIP)
+
+	// a round-robin name keeps the applied ip while it is still resolved.
+	resolved = []net.IP{net.ParseIP("4.4.4.4"), net.ParseIP("3.3.3.3")}
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal("3.3.3.3", vpnDriver.LastApplied().RemoteEndpoints["gw"].PublicIP)
+	resolved = []net.IP{net.ParseIP("3.3.3.3"), net.ParseIP("5.5.5.5")}
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal("3.3.3.3", vpnDriver.LastApplied().RemoteEndpoints["gw"].PublicIP)
+	a.Equal(2, vpnDriver.ApplyCalls(), "the network should not change while the applied ip is resolved")
+
+	// otherwise the lowest ip is picked.
+	resolved = []net.IP{net.ParseIP("6.6.6.6"), net.ParseIP("5.5.5.5")}
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal("5.5.5.5", vpnDriver.LastApplied().RemoteEndpoints["gw"].PublicIP)
+
+	// the public ip of the endpoint is used if the name can not be resolved.
+	lookupErr = errors.New("no such host")
+	a.NoError(c.sync(context.Background(), false))
+	a.Equal("1.1.1.1", vpnDriver.LastApplied().RemoteEndpoints["gw"].PublicIP)
+}
+
+func TestObserveNATTypes(t *testing.T) {
+	a := assert.New(t)
+	observeNATTypes(&types.Network{
+		LocalEndpoint: &types.Endpoint{GatewayName: "gw-local"},
+		RemoteEndpoints: map[types.GatewayName]*types.Endpoint{
+			"gw-1": {GatewayName: "gw-1", UnderNAT: true},
+			"gw-2": {GatewayName: "gw-2", UnderNAT: true},
+		},
+	})
+	a.Equal(float64(1), testutil.ToFloat64(gatewayNATType.WithLabelValues(natTypePublic)))
+	a.Equal(float64(2), testutil.ToFloat64(gatewayNATType.WithLabelValues(natTypeNAT)))
+
+	// gateways which are gone are not counted any more.
+	observeNATTypes(&types.Network{})
+	a.Equal(float64(0), testutil.ToFloat64(gatewayNATType.WithLabelValues(natTypePublic)))
+	a.Equal(float64(0), testutil.ToFloat64(gatewayNATType.WithLabelValues(natTypeNAT)))
+}
+
+// conflictClient always fails updates with a conflict error.
+type conflictClient struct {
+	client.Client
+	updates int
+}
+
+func (c *conflictClient) Update(context.Context, client.Object, ...client.UpdateOption) error {
+	c.updates++
+	return apierrors.NewConflict(schema.GroupResource{Resource: "gateways"}, "gw", errors.New("conflict"))
+}
+
+func TestEngineController_UpdateGatewayPublicIPBackoff(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	gw := &v1alpha1.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Name: "gw"},
+		Spec: v1alpha1.GatewaySpec{
+			Endpoints: []v1alpha1.Endpoint{{NodeName: "node-1"}},
+		},
+	}
+	cli := &conflictClient{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(gw).Build()}
+	cfg := &config.Config{GatewayUpdateRetry: wait.Backoff{Steps: 3, Duration: time.Millisecond, Factor: 1}}
+	c := &EngineController{
+		nodeName:      "node-1",
+		ravenClient:   cli,
+		updateBackoff: cfg.GatewayUpdateBackoff(),
+	}
+
+	err := c.updateGatewayPublicIP(context.Background(), "gw", "1.1.1.1")
+	a.True(apierrors.IsConflict(err))
+	a.Equal(3, cli.updates, "the update should be tried as many times as the custom backoff steps")
+
+	a.Equal(retry.DefaultBackoff, (&config.Config{}).GatewayUpdateBackoff(), "default backoff should be used if not set")
+}
+
+// hungClient blocks listing until the context is done, like an unresponsive API server.
+type hungClient struct {
+	client.Client
+}
+
+func (c *hungClient) List(ctx context.Context, _ client.ObjectList, _ ...client.ListOption) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestEngineController_SyncTimeout(t *testing.T) {
+	a := assert.New(t)
+	vpnDriver := &enginetesting.VPNDriver{}
+	c := &EngineController{
+		ravenClient: &hungClient{},
+		queue:       workqueue.NewRateLimitingQueue(newRateLimiter(time.Hour, time.Hour)),
+		maxRetries:  3,
+		syncTimeout: 10 * time.Millisecond,
+		routeDriver: &enginetesting.RouteDriver{},
+		vpnDriver:   vpnDriver,
+	}
+	defer c.queue.ShutDown()
+	c.queue.Add("gw")
+
+	a.True(c.processNextWorkItem(context.Background()))
+	err := c.ReadyCheck(nil)
+	a.Error(err)
+	a.Contains(err.Error(), context.DeadlineExceeded.Error())
+	a.Equal(1, c.queue.NumRequeues("gw"), "timed out sync should be retried")
+	a.Equal(0, vpnDriver.ApplyCalls())
+}
+
+// hungVPNDriver blocks Apply until release is closed, like a hung whack call.
+type hungVPNDriver struct {
+	enginetesting.VPNDriver
+	release chan struct{}
+}
+
+func (d *hungVPNDriver) Apply(network *types.Network, routeDriverMTUFn func(*types.Network) (int, error)) error {
+	<-d.release
+	return d.VPNDriver.Apply(network, routeDriverMTUFn)
+}
+
+func TestEngineController_AbandonDriverCall(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	vpnDriver := &hungVPNDriver{release: make(chan struct{})}
+	routeDriver := &enginetesting.RouteDriver{}
+	c := &EngineController{
+		ravenClient:      fake.NewClientBuilder().WithScheme(scheme).Build(),
+		queue:            workqueue.NewRateLimitingQueue(newRateLimiter(time.Hour, time.Hour)),
+		maxRetries:       3,
+		syncTimeout:      10 * time.Millisecond,
+		syncStuckTimeout: 20 * time.Millisecond,
+		routeDriver:      routeDriver,
+		vpnDriver:        vpnDriver,
+	}
+	defer c.queue.ShutDown()
+
+	c.queue.Add("gw")
+	a.True(c.processNextWorkItem(context.Background()))
+	err := c.ReadyCheck(nil)
+	a.Error(err)
+	a.Contains(err.Error(), "vpnDriver.Apply is abandoned")
+	a.Equal(0, routeDriver.ApplyCalls(), "drivers should not be called while the abandoned call is running")
+
+	// the abandoned call is still checked by the liveness check.
+	time.Sleep(30 * time.Millisecond)
+	a.Error(c.LivenessCheck(nil))
+	err = c.sync(context.Background(), true)
+	a.Error(err)
+	a.Contains(err.Error(), "an abandoned driver call is still running")
+
+	close(vpnDriver.release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	a.NoError(c.Shutdown(ctx), "shutdown should wait for the abandoned call")
+	a.NoError(c.LivenessCheck(nil))
+	a.NoError(c.sync(context.Background(), true))
+	a.Equal(1, routeDriver.ApplyCalls())
+}
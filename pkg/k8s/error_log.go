@@ -0,0 +1,73 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"time"
+)
+
+// errorLogInterval is the minimum interval of logging identical consecutive errors of the same event.
+const errorLogInterval = time.Minute
+
+type loggedError struct {
+	msg        string
+	loggedAt   time.Time
+	suppressed int
+}
+
+// errorLogFilter deduplicates identical consecutive sync errors per event, so that a persistent failure
+// does not flood the logs on every requeue. The zero value is ready to use.
+// It is not safe for concurrent use, the engine controller only uses it from the worker.
+type errorLogFilter struct {
+	// now is used to mock the clock in tests.
+	now    func() time.Time
+	errors map[interface{}]*loggedError
+}
+
+// shouldLog reports whether err of the event should be logged.
+// If so, it also returns how many identical errors were suppressed since the error was logged last time.
+func (f *errorLogFilter) shouldLog(event interface{}, err error) (bool, int) {
+	if f.errors == nil {
+		f.errors = make(map[interface{}]*loggedError)
+	}
+	now := time.Now()
+	if f.now != nil {
+		now = f.now()
+	}
+	last, ok := f.errors[event]
+	if !ok || last.msg != err.Error() || now.Sub(last.loggedAt) >= errorLogInterval {
+		suppressed := 0
+		if ok && last.msg == err.Error() {
+			suppressed = last.suppressed
+		}
+		f.errors[event] = &loggedError{msg: err.Error(), loggedAt: now}
+		return true, suppressed
+	}
+	last.suppressed++
+	return false, 0
+}
+
+// forget clears the error of the event, and returns how many identical errors were suppressed
+// since the error was logged last time.
+func (f *errorLogFilter) forget(event interface{}) int {
+	last, ok := f.errors[event]
+	if !ok {
+		return 0
+	}
+	delete(f.errors, event)
+	return last.suppressed
+}
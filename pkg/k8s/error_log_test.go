@@ -0,0 +1,59 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorLogFilter(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	f := errorLogFilter{now: func() time.Time { return now }}
+	errA := errors.New("apply failed")
+
+	ok, suppressed := f.shouldLog("gw", errA)
+	a.True(ok, "the first error should be logged")
+	a.Equal(0, suppressed)
+	for i := 0; i < 3; i++ {
+		ok, _ = f.shouldLog("gw", errA)
+		a.False(ok, "identical errors within the interval should be suppressed")
+	}
+
+	ok, _ = f.shouldLog("other-gw", errA)
+	a.True(ok, "errors are deduplicated per event")
+
+	now = now.Add(errorLogInterval)
+	ok, suppressed = f.shouldLog("gw", errA)
+	a.True(ok, "identical errors should be logged again after the interval")
+	a.Equal(3, suppressed)
+
+	ok, _ = f.shouldLog("gw", errA)
+	a.False(ok)
+	ok, suppressed = f.shouldLog("gw", errors.New("list failed"))
+	a.True(ok, "a different error should be logged")
+	a.Equal(0, suppressed)
+
+	ok, _ = f.shouldLog("gw", errors.New("list failed"))
+	a.False(ok)
+	a.Equal(1, f.forget("gw"))
+	a.Equal(0, f.forget("gw"))
+}
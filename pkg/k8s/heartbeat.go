@@ -0,0 +1,282 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/openyurtio/raven/pkg/types"
+)
+
+const (
+	// DefaultHeartbeatInterval and DefaultHeartbeatTimeout are the defaults of the heartbeats between gateways.
+	DefaultHeartbeatInterval = 10 * time.Second
+	DefaultHeartbeatTimeout  = 30 * time.Second
+
+	heartbeatMagic = "RVHB"
+	heartbeatPing  = byte(1)
+	heartbeatPong  = byte(2)
+	// heartbeatLen is the length of a heartbeat, the magic, the type and the send time in unix nanoseconds.
+	heartbeatLen = len(heartbeatMagic) + 1 + 8
+)
+
+// PeerStatus is the heartbeat status of a remote gateway.
+type PeerStatus struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+	// RTTSeconds is the round trip time of the last answered heartbeat, 0 if none is answered yet.
+	RTTSeconds        float64   `json:"rttSeconds,omitempty"`
+	LastHeartbeatTime time.Time `json:"lastHeartbeatTime,omitempty"`
+}
+
+type peerState struct {
+	address string
+	// since is when the peer is added, so that a new peer has the whole timeout to answer.
+	since     time.Time
+	lastReply time.Time
+	rtt       time.Duration
+	healthy   bool
+}
+
+// heartbeater sends UDP heartbeats to the private IPs of the remote gateways and answers theirs.
+// Unlike the keepalives of the vpn drivers, heartbeats are answered by the remote agent, so a peer that does not answer
+// within the timeout is unhealthy even if its vpn connection looks up. Heartbeats only go over the tunnel where it routes
+// the private IPs of the gateways, otherwise they check the path between the gateway nodes.
+type heartbeater struct {
+	port     int
+	interval time.Duration
+	timeout  time.Duration
+	now      func() time.Time
+	conn     net.PacketConn
+
+	mutex sync.Mutex
+	// peers are the remote gateways heartbeats are sent to, indexed by gateway name.
+	peers map[types.GatewayName]*peerState
+}
+
+// newHeartbeater returns nil if port is 0, which disables heartbeats.
+func newHeartbeater(port int, interval, timeout time.Duration) *heartbeater {
+	if port == 0 {
+		return nil
+	}
+	return &heartbeater{
+		port:     port,
+		interval: interval,
+		timeout:  timeout,
+		now:      time.Now,
+		peers:    make(map[types.GatewayName]*peerState),
+	}
+}
+
+// run answers heartbeats, and sends heartbeats to the peers returned by peersFn every interval until ctx is done.
+func (h *heartbeater) run(ctx context.Context, peersFn func() map[types.GatewayName]string) {
+	conn, err := net.ListenPacket("udp4", net.JoinHostPort("", strconv.Itoa(h.port)))
+	if err != nil {
+		klog.ErrorS(err, "error listening for heartbeats, heartbeats are disabled", "port", h.port)
+		return
+	}
+	h.conn = conn
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go h.serve()
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.setPeers(peersFn())
+			h.check()
+			h.sendPings()
+		}
+	}
+}
+
+// serve reads heartbeats until the connection is closed.
+func (h *heartbeater) serve() {
+	buf := make([]byte, heartbeatLen)
+	for {
+		n, from, err := h.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				klog.ErrorS(err, "error reading heartbeat")
+			}
+			return
+		}
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if reply := h.handle(buf[:n], udpAddr.IP.String()); reply != nil {
+			if _, err := h.conn.WriteTo(reply, from); err != nil {
+				klog.V(4).InfoS("error answering heartbeat", "from", from, "err", err)
+			}
+		}
+	}
+}
+
+// handle returns the answer of a ping, and records the round trip time of a pong from a peer.
+func (h *heartbeater) handle(packet []byte, from string) []byte {
+	if len(packet) != heartbeatLen || !bytes.HasPrefix(packet, []byte(heartbeatMagic)) {
+		return nil
+	}
+	switch packet[len(heartbeatMagic)] {
+	case heartbeatPing:
+		reply := make([]byte, heartbeatLen)
+		copy(reply, packet)
+		reply[len(heartbeatMagic)] = heartbeatPong
+		return reply
+	case heartbeatPong:
+		h.recordReply(from, heartbeatTime(packet))
+	}
+	return nil
+}
+
+// heartbeatTime and putHeartbeatTime read and write the send time of a heartbeat.
+func heartbeatTime(packet []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(packet[len(heartbeatMagic)+1:])))
+}
+
+func putHeartbeatTime(packet []byte, t time.Time) {
+	binary.BigEndian.PutUint64(packet[len(heartbeatMagic)+1:], uint64(t.UnixNano()))
+}
+
+func (h *heartbeater) recordReply(from string, sent time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	now := h.now()
+	for name, p := range h.peers {
+		if p.address != from {
+			continue
+		}
+		p.lastReply = now
+		p.rtt = now.Sub(sent)
+		peerRTT.WithLabelValues(string(name)).Set(p.rtt.Seconds())
+		if !p.healthy {
+			klog.InfoS("remote gateway answers heartbeats again", "gateway", name, "address", p.address, "rtt", p.rtt)
+			p.healthy = true
+			peerHealthy.WithLabelValues(string(name)).Set(1)
+		}
+	}
+}
+
+// setPeers replaces the peers, keeping the state of the peers whose address is not changed.
+func (h *heartbeater) setPeers(peers map[types.GatewayName]string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for name, p := range h.peers {
+		if addr, ok := peers[name]; !ok || addr != p.address {
+			delete(h.peers, name)
+			peerRTT.DeleteLabelValues(string(name))
+			peerHealthy.DeleteLabelValues(string(name))
+		}
+	}
+	for name, addr := range peers {
+		if _, ok := h.peers[name]; !ok {
+			h.peers[name] = &peerState{address: addr, since: h.now(), healthy: true}
+			peerHealthy.WithLabelValues(string(name)).Set(1)
+		}
+	}
+}
+
+// check marks the peers that do not answer heartbeats within the timeout unhealthy.
+func (h *heartbeater) check() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	now := h.now()
+	for name, p := range h.peers {
+		last := p.since
+		if p.lastReply.After(last) {
+			last = p.lastReply
+		}
+		if p.healthy && now.Sub(last) > h.timeout {
+			klog.InfoS("remote gateway does not answer heartbeats", "gateway", name, "address", p.address, "timeout", h.timeout)
+			p.healthy = false
+			peerHealthy.WithLabelValues(string(name)).Set(0)
+		}
+	}
+}
+
+func (h *heartbeater) sendPings() {
+	h.mutex.Lock()
+	addrs := make([]string, 0, len(h.peers))
+	for _, p := range h.peers {
+		addrs = append(addrs, p.address)
+	}
+	h.mutex.Unlock()
+
+	ping := make([]byte, heartbeatLen)
+	copy(ping, heartbeatMagic)
+	ping[len(heartbeatMagic)] = heartbeatPing
+	for _, addr := range addrs {
+		putHeartbeatTime(ping, h.now())
+		to, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(addr, strconv.Itoa(h.port)))
+		if err != nil {
+			klog.ErrorS(err, "error resolving heartbeat address", "address", addr)
+			continue
+		}
+		if _, err := h.conn.WriteTo(ping, to); err != nil {
+			klog.V(4).InfoS("error sending heartbeat", "address", addr, "err", err)
+		}
+	}
+}
+
+// status returns the heartbeat status of the peers, indexed by gateway name.
+func (h *heartbeater) status() map[string]PeerStatus {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	status := make(map[string]PeerStatus, len(h.peers))
+	for name, p := range h.peers {
+		status[string(name)] = PeerStatus{
+			Address:           p.address,
+			Healthy:           p.healthy,
+			RTTSeconds:        p.rtt.Seconds(),
+			LastHeartbeatTime: p.lastReply,
+		}
+	}
+	return status
+}
+
+// heartbeatPeers returns the private IPs of the remote gateways if the current node is the local gateway node
+// of the applied network, other nodes do not send heartbeats.
+func (c *EngineController) heartbeatPeers() map[types.GatewayName]string {
+	peers := make(map[types.GatewayName]string)
+	nw := c.Snapshot().Network
+	if nw == nil || nw.LocalEndpoint == nil || string(nw.LocalEndpoint.NodeName) != c.nodeName {
+		return peers
+	}
+	for name, ep := range nw.RemoteEndpoints {
+		peers[name] = ep.PrivateIP
+	}
+	return peers
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openyurtio/raven/pkg/types"
+)
+
+func TestHeartbeater_Timeout(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	h := newHeartbeater(4790, time.Second, 3*time.Second)
+	h.now = func() time.Time { return now }
+	h.setPeers(map[types.GatewayName]string{"gw-1": "192.168.0.1"})
+	ping := make([]byte, heartbeatLen)
+	copy(ping, heartbeatMagic)
+	ping[len(heartbeatMagic)] = heartbeatPing
+
+	// a new peer has the whole timeout to answer.
+	now = now.Add(2 * time.Second)
+	h.check()
+	a.True(h.status()["gw-1"].Healthy)
+
+	now = now.Add(2 * time.Second)
+	h.check()
+	a.False(h.status()["gw-1"].Healthy)
+	a.Equal(float64(0), testutil.ToFloat64(peerHealthy.WithLabelValues("gw-1")))
+
+	// the answer of a ping is a pong of the same send time.
+	pong := h.handle(ping, "192.168.0.1")
+	a.Equal(heartbeatPong, pong[len(heartbeatMagic)])
+	a.Nil(h.handle(ping[:heartbeatLen-1], "192.168.0.1"))
+	putHeartbeatTime(pong, now.Add(-50*time.Millisecond))
+
+	// pongs from unknown addresses are ignored.
+	a.Nil(h.handle(pong, "192.168.0.2"))
+	a.False(h.status()["gw-1"].Healthy)
+
+	a.Nil(h.handle(pong, "192.168.0.1"))
+	status := h.status()["gw-1"]
+	a.True(status.Healthy)
+	a.InDelta(0.05, status.RTTSeconds, 0.001)
+	a.InDelta(0.05, testutil.ToFloat64(peerRTT.WithLabelValues("gw-1")), 0.001)
+
+	// peers that are removed are not exported anymore.
+	h.setPeers(nil)
+	a.Empty(h.status())
+	a.Equal(0, testutil.CollectAndCount(peerRTT))
+}
+
+func TestHeartbeater_Run(t *testing.T) {
+	a := assert.New(t)
+	// the heartbeater answers its own heartbeats on the loopback address.
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	a.NoError(err)
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	h := newHeartbeater(port, 10*time.Millisecond, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.run(ctx, func() map[types.GatewayName]string {
+		return map[types.GatewayName]string{"gw-1": "127.0.0.1"}
+	})
+	a.Eventually(func() bool {
+		return !h.status()["gw-1"].LastHeartbeatTime.IsZero()
+	}, 5*time.Second, 10*time.Millisecond)
+	a.True(h.status()["gw-1"].Healthy)
+}
+
+func TestEngineController_HeartbeatPeers(t *testing.T) {
+	a := assert.New(t)
+	c := &EngineController{nodeName: "node-1"}
+	a.Empty(c.heartbeatPeers())
+
+	c.appliedNetwork = &types.Network{
+		LocalEndpoint: &types.Endpoint{GatewayName: "gw-1", NodeName: "node-1", PrivateIP: "192.168.0.1"},
+		RemoteEndpoints: map[types.GatewayName]*types.Endpoint{
+			"gw-2": {GatewayName: "gw-2", NodeName: "node-2", PrivateIP: "192.168.0.2"},
+		},
+	}
+	a.Equal(map[types.GatewayName]string{"gw-2": "192.168.0.2"}, c.heartbeatPeers())
+
+	// only the gateway node sends heartbeats.
+	c.nodeName = "node-3"
+	a.Empty(c.heartbeatPeers())
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vishvananda/netlink"
+	"k8s.io/klog/v2"
+)
+
+// can be modified for testing.
+var linkStatistics = func(name string) (*netlink.LinkStatistics, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return link.Attrs().Statistics, nil
+}
+
+// linkOwner is implemented by the drivers that manage links, e.g. the vxlan and WireGuard devices.
+type linkOwner interface {
+	// Links returns the names of the links managed by the driver.
+	Links() []string
+}
+
+var linkStatsLabels = []string{"interface", "gateway"}
+
+// linkStatsCollector exports the statistics of the links managed by the drivers as counters.
+// The statistics are sampled by EngineController.sampleLinkStats instead of read on every scrape.
+type linkStatsCollector struct {
+	rxBytes   *prometheus.Desc
+	txBytes   *prometheus.Desc
+	rxPackets *prometheus.Desc
+	txPackets *prometheus.Desc
+	rxErrors  *prometheus.Desc
+	txErrors  *prometheus.Desc
+
+	mutex sync.Mutex
+	// samples are the last sampled statistics, indexed by link name.
+	samples map[string]linkSample
+}
+
+type linkSample struct {
+	gateway string
+	stats   netlink.LinkStatistics
+}
+
+func newLinkStatsCollector() *linkStatsCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(name, help, linkStatsLabels, nil)
+	}
+	return &linkStatsCollector{
+		rxBytes:   desc("raven_tunnel_rx_bytes_total", "Bytes received by the link managed by raven."),
+		txBytes:   desc("raven_tunnel_tx_bytes_total", "Bytes sent by the link managed by raven."),
+		rxPackets: desc("raven_tunnel_rx_packets_total", "Packets received by the link managed by raven."),
+		txPackets: desc("raven_tunnel_tx_packets_total", "Packets sent by the link managed by raven."),
+		rxErrors:  desc("raven_tunnel_rx_errors_total", "Receive errors of the link managed by raven."),
+		txErrors:  desc("raven_tunnel_tx_errors_total", "Transmit errors of the link managed by raven."),
+		samples:   make(map[string]linkSample),
+	}
+}
+
+func (l *linkStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{l.rxBytes, l.txBytes, l.rxPackets, l.txPackets, l.rxErrors, l.txErrors} {
+		ch <- d
+	}
+}
+
+func (l *linkStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for name, s := range l.samples {
+		counter := func(d *prometheus.Desc, v uint64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), name, s.gateway)
+		}
+		counter(l.rxBytes, s.stats.RxBytes)
+		counter(l.txBytes, s.stats.TxBytes)
+		counter(l.rxPackets, s.stats.RxPackets)
+		counter(l.txPackets, s.stats.TxPackets)
+		counter(l.rxErrors, s.stats.RxErrors)
+		counter(l.txErrors, s.stats.TxErrors)
+	}
+}
+
+// set replaces the samples, so that links which are deleted are not exported anymore.
+func (l *linkStatsCollector) set(samples map[string]linkSample) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.samples = samples
+}
+
+// sampleLinkStats reads the statistics of the links managed by the drivers.
+// Links that do not exist are skipped, e.g. the WireGuard device on a node that is not the gateway.
+func (c *EngineController) sampleLinkStats() {
+	var gateway string
+	if nw := c.Snapshot().Network; nw != nil && nw.LocalEndpoint != nil {
+		gateway = string(nw.LocalEndpoint.GatewayName)
+	}
+	samples := make(map[string]linkSample)
+	for _, d := range []interface{}{c.routeDriver, c.vpnDriver} {
+		owner, ok := d.(linkOwner)
+		if !ok {
+			continue
+		}
+		for _, name := range owner.Links() {
+			stats, err := linkStatistics(name)
+			if err != nil {
+				if !errors.As(err, &netlink.LinkNotFoundError{}) {
+					klog.ErrorS(err, "error reading link statistics", "link", name)
+				}
+				continue
+			}
+			if stats == nil {
+				continue
+			}
+			samples[name] = linkSample{gateway: gateway, stats: *stats}
+		}
+	}
+	tunnelLinkStats.set(samples)
+}
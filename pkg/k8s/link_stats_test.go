@@ -0,0 +1,78 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+
+	enginetesting "github.com/openyurtio/raven/pkg/networkengine/testing"
+	"github.com/openyurtio/raven/pkg/types"
+)
+
+type linkRouteDriver struct {
+	enginetesting.RouteDriver
+	links []string
+}
+
+func (l *linkRouteDriver) Links() []string {
+	return l.links
+}
+
+func TestEngineController_SampleLinkStats(t *testing.T) {
+	a := assert.New(t)
+	defer func(fn func(string) (*netlink.LinkStatistics, error)) { linkStatistics = fn }(linkStatistics)
+	linkStatistics = func(name string) (*netlink.LinkStatistics, error) {
+		switch name {
+		case "raven0":
+			return &netlink.LinkStatistics{RxBytes: 100, TxBytes: 200, RxPackets: 1, TxPackets: 2}, nil
+		case "missing":
+			return nil, netlink.LinkNotFoundError{}
+		default:
+			return nil, errors.New("netlink failed")
+		}
+	}
+	c := &EngineController{
+		routeDriver: &linkRouteDriver{links: []string{"raven0", "missing", "broken"}},
+		// the vpn driver manages no link.
+		vpnDriver: &enginetesting.VPNDriver{},
+		appliedNetwork: &types.Network{
+			LocalEndpoint: &types.Endpoint{GatewayName: "gw"},
+		},
+	}
+
+	c.sampleLinkStats()
+	expected := `
+# HELP raven_tunnel_rx_bytes_total Bytes received by the link managed by raven.
+# TYPE raven_tunnel_rx_bytes_total counter
+raven_tunnel_rx_bytes_total{gateway="gw",interface="raven0"} 100
+# HELP raven_tunnel_tx_bytes_total Bytes sent by the link managed by raven.
+# TYPE raven_tunnel_tx_bytes_total counter
+raven_tunnel_tx_bytes_total{gateway="gw",interface="raven0"} 200
+`
+	a.NoError(testutil.CollectAndCompare(tunnelLinkStats, strings.NewReader(expected), "raven_tunnel_rx_bytes_total", "raven_tunnel_tx_bytes_total"))
+
+	// links that are deleted are not exported anymore.
+	c.routeDriver = &linkRouteDriver{links: []string{"missing"}}
+	c.sampleLinkStats()
+	a.Equal(0, testutil.CollectAndCount(tunnelLinkStats))
+}
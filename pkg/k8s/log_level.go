@@ -0,0 +1,62 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/spf13/pflag"
+	"k8s.io/apiserver/pkg/server/routes"
+	"k8s.io/component-base/logs"
+	"k8s.io/klog/v2"
+)
+
+// LogVerbosityPath and LogVModulePath are the paths on the metrics server to change the log verbosity at runtime,
+// with the value in the body of a PUT request, e.g. "4" and "wireguard=4,engine_controller=4".
+// They are only served if the metrics endpoint is authenticated.
+// The vmodule patterns match the source file names of the components, e.g. engine_controller, public_ip,
+// vxlan, wireguard, libreswan and netlink, without the .go suffix.
+const (
+	LogVerbosityPath = "/debug/flags/v"
+	LogVModulePath   = "/debug/flags/vmodule"
+)
+
+// klogFlags binds the klog flags once, both the command line and vmoduleSetter set them.
+var klogFlags = func() *flag.FlagSet {
+	fs := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(fs)
+	return fs
+}()
+
+// AddLogFlags adds the klog flags, e.g. --v and --vmodule, to fs.
+func AddLogFlags(fs *pflag.FlagSet) {
+	fs.AddGoFlagSet(klogFlags)
+}
+
+func vmoduleSetter(val string) (string, error) {
+	if err := klogFlags.Set("vmodule", val); err != nil {
+		return "", fmt.Errorf("failed set klog vmodule %s: %v", val, err)
+	}
+	klog.InfoS("log vmodule changed", "vmodule", val)
+	return fmt.Sprintf("successfully set klog vmodule to %s", val), nil
+}
+
+var (
+	verbosityHandler = routes.StringFlagPutHandler(logs.GlogSetter)
+	vmoduleHandler   = routes.StringFlagPutHandler(vmoduleSetter)
+)
@@ -0,0 +1,46 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog/v2"
+)
+
+func TestVModuleHandler(t *testing.T) {
+	a := assert.New(t)
+	defer func() { a.NoError(klogFlags.Set("vmodule", "")) }()
+	a.False(klog.V(4).Enabled())
+
+	rec := httptest.NewRecorder()
+	vmoduleHandler(rec, httptest.NewRequest(http.MethodPut, LogVModulePath, strings.NewReader("log_level_test=4")))
+	a.Equal(http.StatusOK, rec.Code)
+	a.True(klog.V(4).Enabled(), "verbosity of this file should be raised")
+
+	rec = httptest.NewRecorder()
+	vmoduleHandler(rec, httptest.NewRequest(http.MethodPut, LogVModulePath, strings.NewReader("log_level_test=x")))
+	a.Equal(http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	vmoduleHandler(rec, httptest.NewRequest(http.MethodGet, LogVModulePath, nil))
+	a.Equal(http.StatusNotAcceptable, rec.Code)
+}
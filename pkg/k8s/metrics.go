@@ -0,0 +1,105 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/openyurtio/raven/pkg/types"
+)
+
+var (
+	reconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "raven_tunnel_reconcile_duration_seconds",
+		Help:    "Duration of syncing the network to the drivers, partitioned by route driver and vpn driver.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route_driver", "vpn_driver"})
+
+	reconcileErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "raven_tunnel_reconcile_errors_total",
+		Help: "Total number of failed syncs of the network, partitioned by route driver and vpn driver.",
+	}, []string{"route_driver", "vpn_driver"})
+
+	reconcileQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "raven_tunnel_workqueue_depth",
+		Help: "Current number of gateway events waiting in the work queue of the engine controller.",
+	})
+
+	gatewayNATType = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "raven_gateway_nat_type",
+		Help: "Number of active endpoints of the gateways in the last sync, partitioned by whether they are behind NAT.",
+	}, []string{"type"})
+
+	gatewayNATTypeChangesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "raven_gateway_nat_type_changes_total",
+		Help: "Total number of times the active endpoint of a gateway moved behind NAT or out of it.",
+	}, []string{"gateway"})
+
+	tunnelLinkStats = newLinkStatsCollector()
+
+	peerRTT = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "raven_tunnel_peer_rtt_seconds",
+		Help: "Round trip time of the last heartbeat answered by the remote gateway.",
+	}, []string{"peer"})
+
+	peerHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "raven_tunnel_peer_healthy",
+		Help: "Whether the remote gateway answered a heartbeat within the heartbeat timeout, 1 for healthy.",
+	}, []string{"peer"})
+)
+
+const (
+	natTypePublic = "public"
+	natTypeNAT    = "nat"
+)
+
+func init() {
+	metrics.Registry.MustRegister(reconcileDuration, reconcileErrorsTotal, reconcileQueueDepth, gatewayNATType, gatewayNATTypeChangesTotal, tunnelLinkStats,
+		peerRTT, peerHealthy)
+}
+
+// observeNATTypes records how many active endpoints of the network are behind NAT.
+func observeNATTypes(nw *types.Network) {
+	counts := map[string]int{natTypePublic: 0, natTypeNAT: 0}
+	count := func(ep *types.Endpoint) {
+		if ep.UnderNAT {
+			counts[natTypeNAT]++
+		} else {
+			counts[natTypePublic]++
+		}
+	}
+	if nw.LocalEndpoint != nil {
+		count(nw.LocalEndpoint)
+	}
+	for _, ep := range nw.RemoteEndpoints {
+		count(ep)
+	}
+	for natType, n := range counts {
+		gatewayNATType.WithLabelValues(natType).Set(float64(n))
+	}
+}
+
+// observeReconcile records the duration and result of a sync.
+func observeReconcile(routeDriver, vpnDriver string, start time.Time, err error) {
+	reconcileDuration.WithLabelValues(routeDriver, vpnDriver).Observe(time.Since(start).Seconds())
+	if err != nil {
+		reconcileErrorsTotal.WithLabelValues(routeDriver, vpnDriver).Inc()
+	}
+}
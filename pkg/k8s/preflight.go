@@ -0,0 +1,86 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/openyurtio/openyurt/pkg/apis/raven/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// EventPreflightFailed is the event reason indicating the agent of a gateway node exits because a prerequisite of
+// the drivers is missing.
+const EventPreflightFailed = "PreflightFailed"
+
+// RecordPreflightFailure records the failed preflight check on the gateways the node is an endpoint of.
+// The manager is not started yet and the agent exits right after, so the gateways are read by reader from the
+// API server, and the events are created before returning instead of by the asynchronous event recorder.
+func RecordPreflightFailure(ctx context.Context, reader client.Reader, events typedcorev1.EventsGetter, nodeName string, checkErr error) error {
+	var gws v1alpha1.GatewayList
+	if err := reader.List(ctx, &gws); err != nil {
+		return fmt.Errorf("error listing gateways: %s", err)
+	}
+	for i := range gws.Items {
+		gw := &gws.Items[i]
+		if !isGatewayEndpoint(gw, nodeName) {
+			continue
+		}
+		now := metav1.NewTime(time.Now())
+		ev := &corev1.Event{
+			ObjectMeta: metav1.ObjectMeta{
+				// the same name as the events of the event recorder.
+				Name:      fmt.Sprintf("%v.%x", gw.Name, now.UnixNano()),
+				Namespace: metav1.NamespaceDefault,
+			},
+			InvolvedObject: corev1.ObjectReference{
+				Kind:            "Gateway",
+				APIVersion:      v1alpha1.GroupVersion.String(),
+				Name:            gw.Name,
+				UID:             gw.UID,
+				ResourceVersion: gw.ResourceVersion,
+			},
+			Reason:         EventPreflightFailed,
+			Message:        fmt.Sprintf("agent on node %s exits: %v", nodeName, checkErr),
+			Source:         corev1.EventSource{Component: "raven-agent", Host: nodeName},
+			FirstTimestamp: now,
+			LastTimestamp:  now,
+			Count:          1,
+			Type:           corev1.EventTypeWarning,
+		}
+		if _, err := events.Events(ev.Namespace).Create(ctx, ev, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("error creating event of gateway %s: %s", gw.Name, err)
+		}
+		klog.V(2).InfoS("preflight failure recorded", "gateway", gw.Name, "node", nodeName)
+	}
+	return nil
+}
+
+func isGatewayEndpoint(gw *v1alpha1.Gateway, nodeName string) bool {
+	for _, ep := range gw.Spec.Endpoints {
+		if ep.NodeName == nodeName {
+			return true
+		}
+	}
+	return false
+}
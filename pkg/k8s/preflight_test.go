@@ -0,0 +1,69 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/openyurtio/openyurt/pkg/apis/raven/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRecordPreflightFailure(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	gateway := func(name string, nodeNames ...string) *v1alpha1.Gateway {
+		gw := &v1alpha1.Gateway{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		for _, n := range nodeNames {
+			gw.Spec.Endpoints = append(gw.Spec.Endpoints, v1alpha1.Endpoint{NodeName: n})
+		}
+		return gw
+	}
+	reader := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		gateway("gw-local", "node-1", "node-2"),
+		gateway("gw-other", "node-3"),
+	).Build()
+	clientset := kubefake.NewSimpleClientset()
+
+	checkErr := errors.New("wireguard kernel module not loaded; run modprobe wireguard")
+	a.NoError(RecordPreflightFailure(context.Background(), reader, clientset.CoreV1(), "node-2", checkErr))
+	events, err := clientset.CoreV1().Events(metav1.NamespaceDefault).List(context.Background(), metav1.ListOptions{})
+	a.NoError(err)
+	if a.Len(events.Items, 1, "only the gateway of the node should get the event") {
+		ev := events.Items[0]
+		a.Equal("gw-local", ev.InvolvedObject.Name)
+		a.Equal("Gateway", ev.InvolvedObject.Kind)
+		a.Equal(corev1.EventTypeWarning, ev.Type)
+		a.Equal(EventPreflightFailed, ev.Reason)
+		a.Contains(ev.Message, "run modprobe wireguard")
+	}
+
+	// a node that is not an endpoint of any gateway records nothing.
+	clientset = kubefake.NewSimpleClientset()
+	a.NoError(RecordPreflightFailure(context.Background(), reader, clientset.CoreV1(), "node-4", checkErr))
+	events, err = clientset.CoreV1().Events(metav1.NamespaceDefault).List(context.Background(), metav1.ListOptions{})
+	a.NoError(err)
+	a.Empty(events.Items)
+}
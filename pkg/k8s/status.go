@@ -0,0 +1,74 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/openyurtio/raven/pkg/types"
+)
+
+// StatusPath is the path on the metrics server that serves the status of the engine controller. It is only
+// served if the metrics endpoint is authenticated, as the status lists the peers of the node.
+const StatusPath = "/debug/status"
+
+// Status is a snapshot of what the engine controller currently believes the state is.
+type Status struct {
+	NodeName      string    `json:"nodeName"`
+	RouteDriver   string    `json:"routeDriver"`
+	VPNDriver     string    `json:"vpnDriver"`
+	DryRun        bool      `json:"dryRun"`
+	LastSyncTime  time.Time `json:"lastSyncTime"`
+	LastSyncError string    `json:"lastSyncError,omitempty"`
+	// Network is the network most recently applied to the drivers, nil if no network is applied yet.
+	Network *types.Network `json:"network,omitempty"`
+	// Peers is the heartbeat status of the remote gateways, indexed by gateway name, nil if heartbeats are disabled.
+	Peers map[string]PeerStatus `json:"peers,omitempty"`
+}
+
+// Snapshot returns the current status of the engine controller.
+func (c *EngineController) Snapshot() Status {
+	c.syncStatusMutex.RLock()
+	defer c.syncStatusMutex.RUnlock()
+	status := Status{
+		NodeName:     c.nodeName,
+		RouteDriver:  c.routeDriverName,
+		VPNDriver:    c.vpnDriverName,
+		DryRun:       c.dryRun,
+		LastSyncTime: c.lastSyncTime,
+		Network:      c.appliedNetwork.Copy(),
+		Peers:        c.heartbeat.status(),
+	}
+	if c.lastSyncErr != nil {
+		status.LastSyncError = c.lastSyncErr.Error()
+	}
+	return status
+}
+
+// serveStatus writes the snapshot of the engine controller as JSON.
+func (c *EngineController) serveStatus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(c.Snapshot()); err != nil {
+		klog.ErrorS(err, "error writing engine controller status")
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/openyurtio/openyurt/pkg/apis/raven/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	enginetesting "github.com/openyurtio/raven/pkg/networkengine/testing"
+)
+
+func TestEngineController_SyncSpans(t *testing.T) {
+	a := assert.New(t)
+	exporter := tracetest.NewInMemoryExporter()
+	defer func(t trace.Tracer) { tracer = t }(tracer)
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)).Tracer("test")
+
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	c := &EngineController{
+		ravenClient: fake.NewClientBuilder().WithScheme(scheme).Build(),
+		queue:       workqueue.NewRateLimitingQueue(newRateLimiter(time.Millisecond, time.Millisecond)),
+		maxRetries:  1,
+		routeDriver: &enginetesting.RouteDriver{},
+		vpnDriver:   &enginetesting.VPNDriver{Driver: enginetesting.Driver{ApplyErr: errors.New("connection failed")}},
+	}
+	defer c.queue.ShutDown()
+	c.queue.Add("gw")
+	a.True(c.processNextWorkItem(context.Background()))
+
+	spans := make(map[string]*sdktrace.SpanSnapshot)
+	for _, s := range exporter.GetSpans() {
+		spans[s.Name] = s
+	}
+	a.Len(spans, 3)
+	root := spans["sync"]
+	a.NotNil(root)
+	a.Equal(codes.Error, root.StatusCode)
+	for _, name := range []string{"vpnDriver.Apply", "routeDriver.Apply"} {
+		a.Contains(spans, name)
+		a.Equal(root.SpanContext.SpanID(), spans[name].Parent.SpanID(), "%s should be a child of the sync span", name)
+	}
+	a.Equal(codes.Error, spans["vpnDriver.Apply"].StatusCode)
+	a.Equal(codes.Unset, spans["routeDriver.Apply"].StatusCode)
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/openyurtio/openyurt/pkg/apis/raven/v1alpha1"
+	"github.com/vdobler/ht/errorlist"
+)
+
+// validateGateway validates the gateway that has an active endpoint with public IP,
+// so that malformed addresses never reach the route driver and vpn driver.
+func validateGateway(gw *v1alpha1.Gateway) error {
+	errList := errorlist.List{}
+	endpoints := make(map[string]struct{})
+	for _, v := range gw.Spec.Endpoints {
+		if _, ok := endpoints[v.NodeName]; ok {
+			errList = errList.Append(fmt.Errorf("duplicate endpoint of node %s", v.NodeName))
+		}
+		endpoints[v.NodeName] = struct{}{}
+	}
+
+	nodes := make(map[string]struct{})
+	for _, v := range gw.Status.Nodes {
+		if v.NodeName == "" {
+			errList = errList.Append(fmt.Errorf("node with private ip %s has empty node name", v.PrivateIP))
+			continue
+		}
+		if _, ok := nodes[v.NodeName]; ok {
+			errList = errList.Append(fmt.Errorf("duplicate node %s", v.NodeName))
+		}
+		nodes[v.NodeName] = struct{}{}
+		if !isIPv4(v.PrivateIP) {
+			errList = errList.Append(fmt.Errorf("node %s has invalid private ip %q", v.NodeName, v.PrivateIP))
+		}
+		for _, subnet := range v.Subnets {
+			if _, _, err := net.ParseCIDR(subnet); err != nil {
+				errList = errList.Append(fmt.Errorf("node %s has invalid subnet %q", v.NodeName, subnet))
+			}
+		}
+	}
+
+	aep := gw.Status.ActiveEndpoint
+	if aep == nil {
+		errList = errList.Append(fmt.Errorf("no active endpoint"))
+		return errList.AsError()
+	}
+	if !isIPv4(aep.PublicIP) {
+		errList = errList.Append(fmt.Errorf("active endpoint has invalid public ip %q", aep.PublicIP))
+	}
+	if _, ok := nodes[aep.NodeName]; !ok {
+		errList = errList.Append(fmt.Errorf("node %s of active endpoint is not found in nodes", aep.NodeName))
+	}
+	return errList.AsError()
+}
+
+func isIPv4(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() != nil
+}
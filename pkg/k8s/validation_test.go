@@ -0,0 +1,136 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8s
+
+import (
+	"testing"
+
+	"github.com/openyurtio/openyurt/pkg/apis/raven/v1alpha1"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestGateway(mutate func(gw *v1alpha1.Gateway)) *v1alpha1.Gateway {
+	gw := &v1alpha1.Gateway{
+		Spec: v1alpha1.GatewaySpec{
+			Endpoints: []v1alpha1.Endpoint{
+				{NodeName: "node-1", PublicIP: "1.1.1.1"},
+				{NodeName: "node-2"},
+			},
+		},
+		Status: v1alpha1.GatewayStatus{
+			Nodes: []v1alpha1.NodeInfo{
+				{NodeName: "node-1", PrivateIP: "192.168.1.1", Subnets: []string{"10.10.1.0/24"}},
+				{NodeName: "node-2", PrivateIP: "192.168.1.2", Subnets: []string{"10.10.2.0/24"}},
+			},
+			ActiveEndpoint: &v1alpha1.Endpoint{NodeName: "node-1", PublicIP: "1.1.1.1"},
+		},
+	}
+	gw.Name = "gw-1"
+	if mutate != nil {
+		mutate(gw)
+	}
+	return gw
+}
+
+func TestValidateGateway(t *testing.T) {
+	testcases := []struct {
+		name        string
+		gateway     *v1alpha1.Gateway
+		expectedErr string
+	}{
+		{
+			name:    "valid",
+			gateway: newTestGateway(nil),
+		},
+		{
+			name: "duplicate-endpoint",
+			gateway: newTestGateway(func(gw *v1alpha1.Gateway) {
+				gw.Spec.Endpoints = append(gw.Spec.Endpoints, v1alpha1.Endpoint{NodeName: "node-2"})
+			}),
+			expectedErr: "duplicate endpoint of node node-2",
+		},
+		{
+			name: "duplicate-node",
+			gateway: newTestGateway(func(gw *v1alpha1.Gateway) {
+				gw.Status.Nodes = append(gw.Status.Nodes, gw.Status.Nodes[1])
+			}),
+			expectedErr: "duplicate node node-2",
+		},
+		{
+			name: "empty-node-name",
+			gateway: newTestGateway(func(gw *v1alpha1.Gateway) {
+				gw.Status.Nodes[1].NodeName = ""
+			}),
+			expectedErr: "empty node name",
+		},
+		{
+			name: "invalid-private-ip",
+			gateway: newTestGateway(func(gw *v1alpha1.Gateway) {
+				gw.Status.Nodes[1].PrivateIP = "192.168.1"
+			}),
+			expectedErr: `node node-2 has invalid private ip "192.168.1"`,
+		},
+		{
+			name: "ipv6-private-ip",
+			gateway: newTestGateway(func(gw *v1alpha1.Gateway) {
+				gw.Status.Nodes[1].PrivateIP = "fd00::2"
+			}),
+			expectedErr: `node node-2 has invalid private ip "fd00::2"`,
+		},
+		{
+			name: "invalid-subnet",
+			gateway: newTestGateway(func(gw *v1alpha1.Gateway) {
+				gw.Status.Nodes[1].Subnets = []string{"10.10.2.0"}
+			}),
+			expectedErr: `node node-2 has invalid subnet "10.10.2.0"`,
+		},
+		{
+			name: "no-active-endpoint",
+			gateway: newTestGateway(func(gw *v1alpha1.Gateway) {
+				gw.Status.ActiveEndpoint = nil
+			}),
+			expectedErr: "no active endpoint",
+		},
+		{
+			name: "invalid-public-ip",
+			gateway: newTestGateway(func(gw *v1alpha1.Gateway) {
+				gw.Status.ActiveEndpoint.PublicIP = "not-an-ip"
+			}),
+			expectedErr: `active endpoint has invalid public ip "not-an-ip"`,
+		},
+		{
+			name: "active-endpoint-node-not-found",
+			gateway: newTestGateway(func(gw *v1alpha1.Gateway) {
+				gw.Status.ActiveEndpoint.NodeName = "node-3"
+			}),
+			expectedErr: "node node-3 of active endpoint is not found in nodes",
+		},
+	}
+	for _, v := range testcases {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			err := validateGateway(v.gateway)
+			if v.expectedErr == "" {
+				a.NoError(err)
+				return
+			}
+			if a.Error(err) {
+				a.Contains(err.Error(), v.expectedErr)
+			}
+		})
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
 
+	networkutil "github.com/openyurtio/raven/pkg/networkengine/util"
 	netlinkutil "github.com/openyurtio/raven/pkg/networkengine/util/netlink"
 )
 
@@ -54,6 +55,9 @@ func ensureVxlanLink(vxlan netlink.Vxlan, vtepIP net.IP) (netlink.Link, error) {
 		}
 		vxLink = linkExist()
 	} else {
+		if err := networkutil.EnsureLinkType(vxLink, vxlan.Type()); err != nil {
+			return nil, err
+		}
 		if isVxlanConfigChanged(&vxlan, vxLink) {
 			if err := netlink.LinkDel(vxLink); err != nil {
 				return nil, fmt.Errorf("error del existing vxlan: %v", err)
@@ -209,6 +213,10 @@ func deleteVxlanLink(linkName string) error {
 		}
 		return fmt.Errorf("error finding vxlan link: %s", err)
 	}
+	if err = networkutil.EnsureLinkType(vxLink, "vxlan"); err != nil {
+		klog.ErrorS(err, "skip deleting link")
+		return nil
+	}
 
 	err = deleteSkbEditFilter(vxLink)
 	if err != nil {
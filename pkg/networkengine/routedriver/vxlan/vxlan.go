@@ -22,6 +22,8 @@ import (
 	"math"
 	"net"
 	"os"
+	"reflect"
+	"strconv"
 	"syscall"
 
 	"github.com/openyurtio/openyurt/pkg/apis/raven/v1alpha1"
@@ -52,6 +54,9 @@ const (
 	ravenMark = 0x40
 
 	ravenMarkSet = "raven-mark-set"
+
+	// tcpIPHeaderLen is the length of IPv4 and TCP headers without options.
+	tcpIPHeaderLen = 40
 )
 
 var (
@@ -69,6 +74,19 @@ type vxlan struct {
 
 	iptables iptablesutil.IPTablesInterface
 	ipset    ipsetutil.IPSetInterface
+
+	// routeProtocol is the protocol of routes added by the driver, so that cleanup only deletes them.
+	routeProtocol netlink.RouteProtocol
+
+	// mssClamp indicates clamping the TCP MSS of traffic sent to remote subnets.
+	mssClamp bool
+	// mssClampRuleSpec is the MSS clamp rule applied in RAVEN-MSS-CHAIN, nil if not applied yet.
+	mssClampRuleSpec []string
+	// mssClampCleaned indicates RAVEN-MSS-CHAIN is known to be deleted, so that it is not cleaned on every Apply.
+	mssClampCleaned bool
+
+	// excludeCIDRs are the destinations that bypass the raven route table.
+	excludeCIDRs []*net.IPNet
 }
 
 func (vx *vxlan) Apply(network *types.Network, vpnDriverMTUFn func() (int, error)) (err error) {
@@ -160,6 +178,10 @@ func (vx *vxlan) Apply(network *types.Network, vpnDriverMTUFn func() (int, error
 		}
 	}
 
+	for k, v := range vx.calExcludeRoutes() {
+		desiredRoutes[k] = v
+	}
+
 	err = networkutil.ApplyRoutes(currentRoutes, desiredRoutes)
 	if err != nil {
 		return fmt.Errorf("error applying routes: %s", err)
@@ -177,9 +199,23 @@ func (vx *vxlan) Apply(network *types.Network, vpnDriverMTUFn func() (int, error
 		return fmt.Errorf("error applying ip set: %s", err)
 	}
 
+	if vx.mssClamp {
+		err = vx.ensureMSSClamp(vx.vxlanIface.Attrs().MTU)
+	} else if !vx.mssClampCleaned {
+		err = vx.cleanMSSClamp()
+	}
+	if err != nil {
+		return fmt.Errorf("error applying mss clamp: %s", err)
+	}
+
 	return nil
 }
 
+// Links returns the vxlan link, whose statistics are exported as metrics.
+func (vx *vxlan) Links() []string {
+	return []string{vxlanLinkName}
+}
+
 func (vx *vxlan) MTU(network *types.Network) (int, error) {
 	// The default link to other nodes in the gateway.
 	var defaultLink netlink.Link
@@ -216,11 +252,26 @@ func (vx *vxlan) nodeInfo(network *types.Network) *v1alpha1.NodeInfo {
 }
 
 func New(cfg *config.Config) (routedriver.Driver, error) {
+	excludeCIDRs, err := networkutil.ParseCIDRs(cfg.ExcludeCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing exclude cidrs: %s", err)
+	}
 	return &vxlan{
-		nodeName: types.NodeName(cfg.NodeName),
+		nodeName:      types.NodeName(cfg.NodeName),
+		routeProtocol: networkutil.RouteProtocol(cfg.RouteProtocol),
+		mssClamp:      cfg.MSSClamp,
+		excludeCIDRs:  excludeCIDRs,
 	}, nil
 }
 
+// Preflight checks the capability and the iptables executable required by the driver.
+func (vx *vxlan) Preflight() error {
+	if err := networkutil.CheckNetAdmin(); err != nil {
+		return err
+	}
+	return networkutil.CheckExecutable("iptables")
+}
+
 func (vx *vxlan) Init() (err error) {
 	vx.iptables, err = iptablesutil.New()
 	if err != nil {
@@ -247,6 +298,92 @@ func (vx *vxlan) ensureRavenMarkChain() error {
 	return nil
 }
 
+// cleanRavenMarkChain deletes RAVEN-MARK-CHAIN and all the rules jumping to it.
+func (vx *vxlan) cleanRavenMarkChain() error {
+	errList := errorlist.List{}
+	// Clean may be called more than one time, so we should ensure chain exists
+	err := vx.iptables.NewChainIfNotExist(iptablesutil.MangleTable, iptablesutil.RavenMarkChain)
+	if err != nil {
+		errList = errList.Append(fmt.Errorf("error ensure chain %s: %s", iptablesutil.RavenMarkChain, err))
+	}
+	err = vx.iptables.DeleteIfExists(iptablesutil.MangleTable, iptablesutil.PreRoutingChain, "-j", iptablesutil.RavenMarkChain)
+	if err != nil {
+		errList = errList.Append(fmt.Errorf("error deleting %s chain rule: %s", iptablesutil.PreRoutingChain, err))
+	}
+	err = vx.iptables.DeleteIfExists(iptablesutil.MangleTable, iptablesutil.OutputChain, "-j", iptablesutil.RavenMarkChain)
+	if err != nil {
+		errList = errList.Append(fmt.Errorf("error deleting %s chain rule: %s", iptablesutil.OutputChain, err))
+	}
+	err = vx.iptables.ClearAndDeleteChain(iptablesutil.MangleTable, iptablesutil.RavenMarkChain)
+	if err != nil {
+		errList = errList.Append(fmt.Errorf("error deleting %s chain %s", iptablesutil.RavenMarkChain, err))
+	}
+	return errList.AsError()
+}
+
+// mssClampRuleSpec returns the rule that clamps the MSS of TCP SYN packets sent to remote subnets to fit the given MTU.
+// The rule is equivalent to the following `iptables` command:
+//
+//	iptables -t mangle -A RAVEN-MSS-CHAIN -m set --match-set raven-mark-set dst -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss {mtu-40}
+func mssClampRuleSpec(mtu int) []string {
+	return []string{"-m", "set", "--match-set", ravenMarkSet, "dst", "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN",
+		"-j", "TCPMSS", "--set-mss", strconv.Itoa(mtu - tcpIPHeaderLen)}
+}
+
+// ensureMSSClamp ensures RAVEN-MSS-CHAIN only contains the MSS clamp rule of the given MTU,
+// and it is jumped to from the POSTROUTING chain.
+func (vx *vxlan) ensureMSSClamp(mtu int) error {
+	desired := mssClampRuleSpec(mtu)
+	// The rules may be flushed externally, e.g. by a firewalld reload, so check them instead of trusting the cache.
+	if reflect.DeepEqual(vx.mssClampRuleSpec, desired) && vx.mssClampExists(desired) {
+		return nil
+	}
+	// The chain may contain a stale rule with a different MTU, so rebuild it.
+	if err := vx.cleanMSSClamp(); err != nil {
+		return err
+	}
+	if err := vx.iptables.NewChainIfNotExist(iptablesutil.MangleTable, iptablesutil.RavenMSSChain); err != nil {
+		return fmt.Errorf("error create %s chain: %s", iptablesutil.RavenMSSChain, err)
+	}
+	if err := vx.iptables.AppendIfNotExists(iptablesutil.MangleTable, iptablesutil.RavenMSSChain, desired...); err != nil {
+		return fmt.Errorf("error adding chain %s rule %v: %s", iptablesutil.RavenMSSChain, desired, err)
+	}
+	if err := vx.iptables.AppendIfNotExists(iptablesutil.MangleTable, iptablesutil.PostRoutingChain, "-j", iptablesutil.RavenMSSChain); err != nil {
+		return fmt.Errorf("error adding chain %s rule: %s", iptablesutil.PostRoutingChain, err)
+	}
+	vx.mssClampRuleSpec = desired
+	vx.mssClampCleaned = false
+	return nil
+}
+
+// mssClampExists returns whether the MSS clamp rule and the rule jumping to RAVEN-MSS-CHAIN both exist.
+// Errors are treated as missing rules, so that the chain is rebuilt.
+func (vx *vxlan) mssClampExists(ruleSpec []string) bool {
+	exists, err := vx.iptables.Exists(iptablesutil.MangleTable, iptablesutil.RavenMSSChain, ruleSpec...)
+	if err != nil || !exists {
+		return false
+	}
+	exists, err = vx.iptables.Exists(iptablesutil.MangleTable, iptablesutil.PostRoutingChain, "-j", iptablesutil.RavenMSSChain)
+	return err == nil && exists
+}
+
+// cleanMSSClamp deletes RAVEN-MSS-CHAIN and the rule jumping to it.
+func (vx *vxlan) cleanMSSClamp() error {
+	// Clean may be called more than one time, so we should ensure chain exists
+	if err := vx.iptables.NewChainIfNotExist(iptablesutil.MangleTable, iptablesutil.RavenMSSChain); err != nil {
+		return fmt.Errorf("error ensure chain %s: %s", iptablesutil.RavenMSSChain, err)
+	}
+	if err := vx.iptables.DeleteIfExists(iptablesutil.MangleTable, iptablesutil.PostRoutingChain, "-j", iptablesutil.RavenMSSChain); err != nil {
+		return fmt.Errorf("error deleting %s chain rule: %s", iptablesutil.PostRoutingChain, err)
+	}
+	if err := vx.iptables.ClearAndDeleteChain(iptablesutil.MangleTable, iptablesutil.RavenMSSChain); err != nil {
+		return fmt.Errorf("error deleting %s chain %s", iptablesutil.RavenMSSChain, err)
+	}
+	vx.mssClampRuleSpec = nil
+	vx.mssClampCleaned = true
+	return nil
+}
+
 func (vx *vxlan) ensureVxlanLink(network *types.Network, vpnDriverMTUFn func() (int, error)) (err error) {
 	var vpnDriverMTU, routeDriverMTU int
 	vpnDriverMTU, err = vpnDriverMTUFn()
@@ -322,6 +459,7 @@ func (vx *vxlan) calRouteOnNonGateway(network *types.Network) map[string]*netlin
 		Scope:     netlink.SCOPE_UNIVERSE,
 		Gw:        via,
 		Table:     routeTableID,
+		Protocol:  vx.routeProtocol,
 		Flags:     int(netlink.FLAG_ONLINK),
 		MTU:       vx.vxlanIface.Attrs().MTU,
 	}
@@ -354,6 +492,7 @@ func (vx *vxlan) calRouteOnGateway(network *types.Network) map[string]*netlink.R
 				Dst:       dst,
 				Gw:        via,
 				Table:     routeTableID,
+				Protocol:  vx.routeProtocol,
 				Flags:     int(netlink.FLAG_ONLINK),
 				MTU:       vx.vxlanIface.Attrs().MTU,
 			}
@@ -363,6 +502,15 @@ func (vx *vxlan) calRouteOnGateway(network *types.Network) map[string]*netlink.R
 	return routes
 }
 
+// calExcludeRoutes calculates and returns the throw routes of the excluded destinations.
+// A throw route terminates the lookup in the raven route table, so the packets are routed by the following tables as if raven is absent.
+// The routes entries format are equivalent to the following `ip route` command:
+//
+//	ip route add throw {exclude_cidrN} table {routeTableID}
+func (vx *vxlan) calExcludeRoutes() map[string]*netlink.Route {
+	return networkutil.ThrowRoutes(vx.excludeCIDRs, routeTableID, vx.routeProtocol)
+}
+
 // calRulesOnNode calculates and returns the desired rules on node.
 // Rules on gateway node are used to configure route policy for the reverse-path route.
 // The rules format are equivalent to the following `ip rule` command:
@@ -449,7 +597,7 @@ func (vx *vxlan) Cleanup() error {
 		errList = errList.Append(err)
 	}
 
-	if err := networkutil.CleanRoutesOnNode(routeTableID); err != nil {
+	if err := networkutil.CleanRoutesOnNode(routeTableID, vx.routeProtocol); err != nil {
 		errList = errList.Append(err)
 	}
 
@@ -457,26 +605,16 @@ func (vx *vxlan) Cleanup() error {
 		errList = errList.Append(err)
 	}
 
-	// Clean may be called more than one time, so we should ensure chain exists
-
-	err := vx.iptables.NewChainIfNotExist(iptablesutil.MangleTable, iptablesutil.RavenMarkChain)
-	if err != nil {
-		errList = errList.Append(fmt.Errorf("error ensure chain %s: %s", iptablesutil.RavenMarkChain, err))
-	}
-	err = vx.iptables.DeleteIfExists(iptablesutil.MangleTable, iptablesutil.PreRoutingChain, "-j", iptablesutil.RavenMarkChain)
-	if err != nil {
-		errList = errList.Append(fmt.Errorf("error deleting %s chain rule: %s", iptablesutil.PreRoutingChain, err))
-	}
-	err = vx.iptables.DeleteIfExists(iptablesutil.MangleTable, iptablesutil.OutputChain, "-j", iptablesutil.RavenMarkChain)
-	if err != nil {
-		errList = errList.Append(fmt.Errorf("error deleting %s chain rule: %s", iptablesutil.OutputChain, err))
+	if err := vx.cleanRavenMarkChain(); err != nil {
+		errList = errList.Append(err)
 	}
-	err = vx.iptables.ClearAndDeleteChain(iptablesutil.MangleTable, iptablesutil.RavenMarkChain)
-	if err != nil {
-		errList = errList.Append(fmt.Errorf("error deleting %s chain %s", iptablesutil.RavenMarkChain, err))
+
+	if err := vx.cleanMSSClamp(); err != nil {
+		errList = errList.Append(err)
 	}
 
 	// Clean may be called more than one time, so we should ensure ip set exists
+	var err error
 	vx.ipset, err = ipsetutil.New(ravenMarkSet)
 	if err != nil {
 		errList = errList.Append(fmt.Errorf("error ensure ip set %s: %s", ravenMarkSet, err))
@@ -17,14 +17,19 @@
 package vxlan
 
 import (
+	"errors"
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/openyurtio/openyurt/pkg/apis/raven/v1alpha1"
 	"github.com/stretchr/testify/assert"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 
+	"github.com/openyurtio/raven/cmd/agent/app/config"
 	networkutil "github.com/openyurtio/raven/pkg/networkengine/util"
+	iptablesutil "github.com/openyurtio/raven/pkg/networkengine/util/iptables"
 	netlinkutil "github.com/openyurtio/raven/pkg/networkengine/util/netlink"
 	"github.com/openyurtio/raven/pkg/types"
 )
@@ -451,3 +456,176 @@ func TestVxlan_Apply(t *testing.T) {
 		})
 	}
 }
+
+type iptablesMock struct {
+	// chains maps table/chain to rules in the chain.
+	chains map[string][]string
+}
+
+func newIPTablesMock() *iptablesMock {
+	return &iptablesMock{
+		chains: map[string][]string{
+			iptablesutil.MangleTable + "/" + iptablesutil.PreRoutingChain:  {},
+			iptablesutil.MangleTable + "/" + iptablesutil.OutputChain:      {},
+			iptablesutil.MangleTable + "/" + iptablesutil.PostRoutingChain: {},
+		},
+	}
+}
+
+func (m *iptablesMock) NewChainIfNotExist(table, chain string) error {
+	if _, ok := m.chains[table+"/"+chain]; !ok {
+		m.chains[table+"/"+chain] = []string{}
+	}
+	return nil
+}
+
+func (m *iptablesMock) ClearAndDeleteChain(table, chain string) error {
+	for _, rules := range m.chains {
+		for _, rule := range rules {
+			if rule == "-j "+chain {
+				return errors.New("chain is still referenced")
+			}
+		}
+	}
+	delete(m.chains, table+"/"+chain)
+	return nil
+}
+
+func (m *iptablesMock) List(table, chain string) ([]string, error) {
+	rules, ok := m.chains[table+"/"+chain]
+	if !ok {
+		return nil, errors.New("chain not found")
+	}
+	return rules, nil
+}
+
+func (m *iptablesMock) Exists(table, chain string, rulespec ...string) (bool, error) {
+	rules, ok := m.chains[table+"/"+chain]
+	if !ok {
+		return false, errors.New("chain not found")
+	}
+	rule := strings.Join(rulespec, " ")
+	for _, v := range rules {
+		if v == rule {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *iptablesMock) AppendIfNotExists(table, chain string, rulespec ...string) error {
+	rules, ok := m.chains[table+"/"+chain]
+	if !ok {
+		return errors.New("chain not found")
+	}
+	rule := strings.Join(rulespec, " ")
+	for _, v := range rules {
+		if v == rule {
+			return nil
+		}
+	}
+	m.chains[table+"/"+chain] = append(rules, rule)
+	return nil
+}
+
+func (m *iptablesMock) DeleteIfExists(table, chain string, rulespec ...string) error {
+	rules, ok := m.chains[table+"/"+chain]
+	if !ok {
+		return errors.New("chain not found")
+	}
+	rule := strings.Join(rulespec, " ")
+	remaining := make([]string, 0, len(rules))
+	for _, v := range rules {
+		if v != rule {
+			remaining = append(remaining, v)
+		}
+	}
+	m.chains[table+"/"+chain] = remaining
+	return nil
+}
+
+func TestVxlan_RavenMarkChain(t *testing.T) {
+	markChain := iptablesutil.MangleTable + "/" + iptablesutil.RavenMarkChain
+	preRoutingChain := iptablesutil.MangleTable + "/" + iptablesutil.PreRoutingChain
+	outputChain := iptablesutil.MangleTable + "/" + iptablesutil.OutputChain
+	a := assert.New(t)
+	ipt := newIPTablesMock()
+	vx := vxlan{
+		iptables: ipt,
+	}
+
+	// ensure several times to make sure the rules are not duplicated.
+	for i := 0; i < 3; i++ {
+		a.NoError(vx.ensureRavenMarkChain())
+	}
+	a.Equal([]string{"-j " + iptablesutil.RavenMarkChain}, ipt.chains[preRoutingChain])
+	a.Equal([]string{"-j " + iptablesutil.RavenMarkChain}, ipt.chains[outputChain])
+
+	// duplicated rules left by a previous agent should all be cleaned up.
+	ipt.chains[preRoutingChain] = append(ipt.chains[preRoutingChain], "-j "+iptablesutil.RavenMarkChain)
+	a.NoError(vx.cleanRavenMarkChain())
+	a.Empty(ipt.chains[preRoutingChain])
+	a.Empty(ipt.chains[outputChain])
+	a.NotContains(ipt.chains, markChain)
+
+	// clean up more than one time should not fail.
+	a.NoError(vx.cleanRavenMarkChain())
+}
+
+func TestVxlan_MSSClamp(t *testing.T) {
+	mssChain := iptablesutil.MangleTable + "/" + iptablesutil.RavenMSSChain
+	postRoutingChain := iptablesutil.MangleTable + "/" + iptablesutil.PostRoutingChain
+	a := assert.New(t)
+	ipt := newIPTablesMock()
+	vx := vxlan{
+		iptables: ipt,
+		mssClamp: true,
+	}
+
+	// apply twice to make sure the rules are not duplicated.
+	a.NoError(vx.ensureMSSClamp(1400))
+	a.NoError(vx.ensureMSSClamp(1400))
+	a.Equal([]string{strings.Join(mssClampRuleSpec(1400), " ")}, ipt.chains[mssChain])
+	a.Equal([]string{"-j " + iptablesutil.RavenMSSChain}, ipt.chains[postRoutingChain])
+	a.Contains(ipt.chains[mssChain][0], "--set-mss 1360")
+
+	// the rules flushed externally should be restored.
+	delete(ipt.chains, mssChain)
+	ipt.chains[postRoutingChain] = []string{}
+	a.NoError(vx.ensureMSSClamp(1400))
+	a.Equal([]string{strings.Join(mssClampRuleSpec(1400), " ")}, ipt.chains[mssChain])
+	a.Equal([]string{"-j " + iptablesutil.RavenMSSChain}, ipt.chains[postRoutingChain])
+
+	// the rule of stale MTU should be replaced.
+	a.NoError(vx.ensureMSSClamp(1300))
+	a.Equal([]string{strings.Join(mssClampRuleSpec(1300), " ")}, ipt.chains[mssChain])
+	a.Equal([]string{"-j " + iptablesutil.RavenMSSChain}, ipt.chains[postRoutingChain])
+
+	a.NoError(vx.cleanMSSClamp())
+	a.NotContains(ipt.chains, mssChain)
+	a.Empty(ipt.chains[postRoutingChain])
+	a.Nil(vx.mssClampRuleSpec)
+	a.True(vx.mssClampCleaned)
+
+	// clean up more than one time should not fail.
+	a.NoError(vx.cleanMSSClamp())
+}
+
+func TestVxlan_ExcludeCIDRs(t *testing.T) {
+	a := assert.New(t)
+	_, err := New(&config.Config{ExcludeCIDRs: []string{"169.254.169.254"}})
+	a.Error(err)
+
+	drv, err := New(&config.Config{ExcludeCIDRs: []string{"169.254.169.254/32", "10.96.0.0/12"}})
+	a.NoError(err)
+	vx := drv.(*vxlan)
+	routes := vx.calExcludeRoutes()
+	a.Len(routes, 2)
+	for _, r := range routes {
+		a.Equal(unix.RTN_THROW, r.Type)
+		a.Equal(routeTableID, r.Table)
+		a.Equal(networkutil.RouteProtocol(0), r.Protocol)
+	}
+	_, metadata, _ := net.ParseCIDR("169.254.169.254/32")
+	a.Contains(routes, networkutil.RouteKey(&netlink.Route{Dst: metadata, Table: routeTableID}))
+}
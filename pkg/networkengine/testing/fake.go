@@ -0,0 +1,139 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package testing provides fake route driver and vpn driver, which record the calls made to them
+// without touching the kernel, for testing the callers of the drivers.
+package testing
+
+import (
+	"sync"
+
+	"github.com/openyurtio/raven/pkg/networkengine/routedriver"
+	"github.com/openyurtio/raven/pkg/networkengine/vpndriver"
+	"github.com/openyurtio/raven/pkg/types"
+)
+
+var (
+	_ routedriver.Driver = (*RouteDriver)(nil)
+	_ vpndriver.Driver   = (*VPNDriver)(nil)
+)
+
+// Driver records the calls shared by RouteDriver and VPNDriver.
+// The error fields are returned by the corresponding methods, and should be set before the driver is used.
+type Driver struct {
+	InitErr    error
+	ApplyErr   error
+	CleanupErr error
+	// DriverMTU is returned by MTU.
+	DriverMTU int
+
+	mu           sync.Mutex
+	initCalls    int
+	cleanupCalls int
+	// applied records the copies of networks passed to Apply, in order.
+	applied []*types.Network
+}
+
+func (d *Driver) Init() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.initCalls++
+	return d.InitErr
+}
+
+func (d *Driver) Cleanup() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cleanupCalls++
+	return d.CleanupErr
+}
+
+func (d *Driver) apply(network *types.Network) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.applied = append(d.applied, network.Copy())
+	return d.ApplyErr
+}
+
+// InitCalls returns how many times Init is called.
+func (d *Driver) InitCalls() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.initCalls
+}
+
+// CleanupCalls returns how many times Cleanup is called.
+func (d *Driver) CleanupCalls() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cleanupCalls
+}
+
+// ApplyCalls returns how many times Apply is called.
+func (d *Driver) ApplyCalls() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.applied)
+}
+
+// Applied returns the networks passed to Apply, in order. The peers of each call are in RemoteEndpoints.
+func (d *Driver) Applied() []*types.Network {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	applied := make([]*types.Network, len(d.applied))
+	copy(applied, d.applied)
+	return applied
+}
+
+// LastApplied returns the network passed to Apply the last time, nil if Apply is never called.
+func (d *Driver) LastApplied() *types.Network {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.applied) == 0 {
+		return nil
+	}
+	return d.applied[len(d.applied)-1]
+}
+
+// RouteDriver is a fake routedriver.Driver.
+type RouteDriver struct {
+	Driver
+}
+
+func (d *RouteDriver) Apply(network *types.Network, _ func() (int, error)) error {
+	return d.apply(network)
+}
+
+func (d *RouteDriver) MTU(_ *types.Network) (int, error) {
+	return d.DriverMTU, nil
+}
+
+// VPNDriver is a fake vpndriver.Driver.
+type VPNDriver struct {
+	Driver
+}
+
+func (d *VPNDriver) Apply(network *types.Network, _ func(*types.Network) (int, error)) error {
+	return d.apply(network)
+}
+
+func (d *VPNDriver) MTU() (int, error) {
+	return d.DriverMTU, nil
+}
+
+func (d *VPNDriver) Overhead() int {
+	return 0
+}
@@ -20,8 +20,10 @@
 package iptablesutil
 
 const (
-	PreRoutingChain = "PREROUTING"
-	OutputChain     = "OUTPUT"
-	RavenMarkChain  = "RAVEN-MARK-CHAIN"
-	MangleTable     = "mangle"
+	PreRoutingChain  = "PREROUTING"
+	OutputChain      = "OUTPUT"
+	PostRoutingChain = "POSTROUTING"
+	RavenMarkChain   = "RAVEN-MARK-CHAIN"
+	RavenMSSChain    = "RAVEN-MSS-CHAIN"
+	MangleTable      = "mangle"
 )
@@ -28,6 +28,7 @@ type IPTablesInterface interface {
 	NewChainIfNotExist(table, chain string) error
 	ClearAndDeleteChain(table, chain string) error
 	List(table, chain string) ([]string, error)
+	Exists(table, chain string, rulespec ...string) (bool, error)
 	AppendIfNotExists(table, chain string, rulespec ...string) error
 	DeleteIfExists(table, chain string, rulespec ...string) error
 }
@@ -87,6 +88,18 @@ func (ipt *iptablesWrapper) List(table, chain string) ([]string, error) {
 	return rules, nil
 }
 
+func (ipt *iptablesWrapper) Exists(table, chain string, rulespec ...string) (bool, error) {
+	exists, err := ipt.IPTables.Exists(table, chain, rulespec...)
+	if err != nil {
+		klog.ErrorS(err, "error on iptables.Exists", "table", table, "chain", chain, "rulespec", rulespec)
+		return false, err
+	}
+	if klog.V(5).Enabled() {
+		klog.V(5).InfoS("iptables.Exists succeeded", "table", table, "chain", chain, "rulespec", rulespec, "exists", exists)
+	}
+	return exists, nil
+}
+
 func (ipt *iptablesWrapper) AppendIfNotExists(table, chain string, rulespec ...string) error {
 	exists, err := ipt.Exists(table, chain, rulespec...)
 	if err == nil && !exists {
@@ -102,8 +115,14 @@ func (ipt *iptablesWrapper) AppendIfNotExists(table, chain string, rulespec ...s
 	return nil
 }
 
+// DeleteIfExists deletes every copy of the rule, so that duplicated rules left by a previous agent are cleaned up too.
 func (ipt *iptablesWrapper) DeleteIfExists(table, chain string, rulespec ...string) error {
-	err := ipt.IPTables.DeleteIfExists(table, chain, rulespec...)
+	exists, err := ipt.Exists(table, chain, rulespec...)
+	for err == nil && exists {
+		if err = ipt.Delete(table, chain, rulespec...); err == nil {
+			exists, err = ipt.Exists(table, chain, rulespec...)
+		}
+	}
 	if err != nil {
 		klog.ErrorS(err, "error on iptables.Delete", "table", table, "chain", chain, "rulespec", rulespec)
 		return err
@@ -40,7 +40,8 @@ var (
 	RuleAdd          = ruleAdd
 	RuleDel          = ruleDel
 
-	XfrmPolicyFlush = xfrmPolicyFlush
+	XfrmPolicyFlush  = xfrmPolicyFlush
+	XfrmPolicyUpdate = xfrmPolicyUpdate
 
 	NeighAppend = neighAppend
 	NeighList   = neighList
@@ -126,6 +127,16 @@ func xfrmPolicyFlush() (err error) {
 	return nil
 }
 
+func xfrmPolicyUpdate(policy *netlink.XfrmPolicy) (err error) {
+	err = netlink.XfrmPolicyUpdate(policy)
+	if err != nil {
+		klog.ErrorS(err, "error on netlink.XfrmPolicyUpdate")
+		return
+	}
+	klog.V(5).InfoS("netlink.XfrmPolicyUpdate succeeded")
+	return
+}
+
 func ruleListFiltered(family int, filter *netlink.Rule, filterMask uint64) (rules []netlink.Rule, err error) {
 	rules, err = netlink.RuleListFiltered(family, filter, filterMask)
 	if err != nil {
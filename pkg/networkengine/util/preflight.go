@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package networkutil
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// capNetAdmin is the bit of CAP_NET_ADMIN in the capability sets.
+const capNetAdmin = 12
+
+// Preflighter is implemented by drivers that check their prerequisites before Init,
+// so that a missing prerequisite is reported clearly instead of failing Init with a cryptic error.
+type Preflighter interface {
+	// Preflight returns an error naming the first missing prerequisite.
+	Preflight() error
+}
+
+var (
+	// lookPath, genlFamilyGet and procStatusFile can be replaced in tests.
+	lookPath       = exec.LookPath
+	genlFamilyGet  = netlink.GenlFamilyGet
+	procStatusFile = "/proc/self/status"
+)
+
+// CheckExecutable returns an error if the executable of the given name or path is not found.
+func CheckExecutable(name string) error {
+	if _, err := lookPath(name); err != nil {
+		return fmt.Errorf("required executable %s is not found: %s", name, err)
+	}
+	return nil
+}
+
+// CheckKernelModule returns an error if the generic netlink family provided by the kernel module is not available.
+// Looking up the family loads the module on demand, so an error means it can not be loaded.
+func CheckKernelModule(module, genlFamily string) error {
+	if _, err := genlFamilyGet(genlFamily); err != nil {
+		return fmt.Errorf("kernel module %s is not loaded: %s, run `modprobe %s` on the node", module, err, module)
+	}
+	return nil
+}
+
+// CheckNetAdmin returns an error if the current process does not have the CAP_NET_ADMIN capability.
+func CheckNetAdmin() error {
+	f, err := os.Open(procStatusFile)
+	if err != nil {
+		return fmt.Errorf("error reading capabilities: %s", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		value := strings.TrimPrefix(line, "CapEff:")
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return fmt.Errorf("error parsing capabilities %q: %s", value, err)
+		}
+		if caps&(1<<capNetAdmin) == 0 {
+			return fmt.Errorf("missing CAP_NET_ADMIN capability, run the agent as a privileged container or add NET_ADMIN to its capabilities")
+		}
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading capabilities: %s", err)
+	}
+	return fmt.Errorf("error reading capabilities: CapEff is not found in %s", procStatusFile)
+}
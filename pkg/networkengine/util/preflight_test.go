@@ -0,0 +1,136 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package networkutil
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestCheckNetAdmin(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    string
+		expectErr string
+	}{
+		{
+			name:   "privileged",
+			status: "Name:\traven-agent\nCapEff:\t000001ffffffffff\n",
+		},
+		{
+			name:      "without-net-admin",
+			status:    "Name:\traven-agent\nCapEff:\t00000000a80425fb\n",
+			expectErr: "missing CAP_NET_ADMIN",
+		},
+		{
+			name:      "no-capabilities",
+			status:    "Name:\traven-agent\n",
+			expectErr: "CapEff is not found",
+		},
+	}
+
+	defer func(file string) { procStatusFile = file }(procStatusFile)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Logf("\tTestCase: %s", tt.name)
+
+			procStatusFile = filepath.Join(t.TempDir(), "status")
+			if err := os.WriteFile(procStatusFile, []byte(tt.status), 0o600); err != nil {
+				t.Fatalf("\t%s\terror writing status file: %v", failed, err)
+			}
+			err := CheckNetAdmin()
+
+			if !errorContains(err, tt.expectErr) {
+				t.Fatalf("\t%s\texpect error %q, but get %v", failed, tt.expectErr, err)
+			}
+			t.Logf("\t%s\texpect error %q, get %v", succeed, tt.expectErr, err)
+		})
+	}
+}
+
+func TestCheckPrerequisites(t *testing.T) {
+	defer func(lookPathFn func(string) (string, error), genlFamilyGetFn func(string) (*netlink.GenlFamily, error)) {
+		lookPath = lookPathFn
+		genlFamilyGet = genlFamilyGetFn
+	}(lookPath, genlFamilyGet)
+	lookPath = func(name string) (string, error) {
+		if name == "iptables" {
+			return "/usr/sbin/iptables", nil
+		}
+		return "", errors.New("executable file not found in $PATH")
+	}
+	genlFamilyGet = func(name string) (*netlink.GenlFamily, error) {
+		if name == "wireguard" {
+			return &netlink.GenlFamily{Name: name}, nil
+		}
+		return nil, errors.New("no such file or directory")
+	}
+
+	tests := []struct {
+		name      string
+		check     func() error
+		expectErr string
+	}{
+		{
+			name:  "executable-found",
+			check: func() error { return CheckExecutable("iptables") },
+		},
+		{
+			name:      "executable-missing",
+			check:     func() error { return CheckExecutable("/usr/libexec/ipsec/whack") },
+			expectErr: "required executable /usr/libexec/ipsec/whack is not found",
+		},
+		{
+			name:  "module-loaded",
+			check: func() error { return CheckKernelModule("wireguard", "wireguard") },
+		},
+		{
+			name:      "module-missing",
+			check:     func() error { return CheckKernelModule("foo", "foo") },
+			expectErr: "run `modprobe foo` on the node",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Logf("\tTestCase: %s", tt.name)
+
+			err := tt.check()
+
+			if !errorContains(err, tt.expectErr) {
+				t.Fatalf("\t%s\texpect error %q, but get %v", failed, tt.expectErr, err)
+			}
+			t.Logf("\t%s\texpect error %q, get %v", succeed, tt.expectErr, err)
+		})
+	}
+}
+
+// errorContains reports whether err contains expect, or err is nil if expect is empty.
+func errorContains(err error, expect string) bool {
+	if expect == "" {
+		return err == nil
+	}
+	return err != nil && strings.Contains(err.Error(), expect)
+}
@@ -26,12 +26,25 @@ import (
 
 	"github.com/vdobler/ht/errorlist"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
 
 	ipsetutil "github.com/openyurtio/raven/pkg/networkengine/util/ipset"
 	netlinkutil "github.com/openyurtio/raven/pkg/networkengine/util/netlink"
 )
 
+// DefaultRouteProtocol is the default protocol (rtproto) of routes managed by raven,
+// which is not used by the kernel and common routing daemons.
+const DefaultRouteProtocol = 90
+
+// RouteProtocol returns the route protocol of the given number, 0 means DefaultRouteProtocol.
+func RouteProtocol(protocol int) netlink.RouteProtocol {
+	if protocol == 0 {
+		return DefaultRouteProtocol
+	}
+	return netlink.RouteProtocol(protocol)
+}
+
 var (
 	AllZeroMAC     = net.HardwareAddr{0, 0, 0, 0, 0, 0}
 	AllZeroAddress = "0.0.0.0/0"
@@ -53,6 +66,50 @@ func RuleKey(rule *netlink.Rule) string {
 	return rule.String()
 }
 
+// ParseCIDRs parses the given CIDRs, e.g. the destinations excluded from the tunnel.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing cidr %s: %s", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// ThrowRoutes returns the throw routes of the given destinations in the route table, indexed by RouteKey.
+// A throw route ends the lookup in the table, so that the destinations are routed by the following rules,
+// eventually by the main table.
+// The routes entries format are equivalent to the following `ip route` command:
+//
+//	ip route add throw {dst} table {routeTableID} proto {protocol}
+func ThrowRoutes(dsts []*net.IPNet, routeTableID int, protocol netlink.RouteProtocol) map[string]*netlink.Route {
+	routes := make(map[string]*netlink.Route)
+	for _, dst := range dsts {
+		nr := &netlink.Route{
+			Scope:    netlink.SCOPE_UNIVERSE,
+			Dst:      dst,
+			Table:    routeTableID,
+			Protocol: protocol,
+			Type:     unix.RTN_THROW,
+		}
+		routes[RouteKey(nr)] = nr
+	}
+	return routes
+}
+
+// EnsureLinkType returns an error if the existing link is not of the given type, e.g. "vxlan" or "wireguard".
+// A link of another type with the same name is not created by raven, so it must be neither adopted nor deleted.
+func EnsureLinkType(link netlink.Link, linkType string) error {
+	if link.Type() != linkType {
+		return fmt.Errorf("link %s already exists with type %s, which is not created by raven, expect type %s",
+			link.Attrs().Name, link.Type(), linkType)
+	}
+	return nil
+}
+
 func ListRulesOnNode(routeTableID int) (map[string]*netlink.Rule, error) {
 	rulesOnNode := make(map[string]*netlink.Rule)
 
@@ -212,14 +269,19 @@ func ApplyFDBs(current, desired map[string]*netlink.Neigh) (err error) {
 	return errList.AsError()
 }
 
-func CleanRoutesOnNode(routeTableID int) error {
+// CleanRoutesOnNode deletes routes in the given route table with the given protocol,
+// so that routes added by others into the route table are kept.
+func CleanRoutesOnNode(routeTableID int, protocol netlink.RouteProtocol) error {
 	errList := errorlist.List{}
-	routes, err := ListRoutesOnNode(routeTableID)
+	routes, err := netlinkutil.RouteListFiltered(
+		netlink.FAMILY_V4,
+		&netlink.Route{Table: routeTableID, Protocol: protocol},
+		netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
 	if err != nil {
 		errList = errList.Append(fmt.Errorf("error listing routes: %s", err))
 	}
-	for _, v := range routes {
-		err = netlinkutil.RouteDel(v)
+	for k := range routes {
+		err = netlinkutil.RouteDel(&routes[k])
 		if err != nil {
 			errList = errList.Append(fmt.Errorf("error deleting routes: %s", err))
 		}
@@ -24,6 +24,9 @@ import (
 	"testing"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	netlinkutil "github.com/openyurtio/raven/pkg/networkengine/util/netlink"
 )
 
 const (
@@ -153,3 +156,91 @@ func TestRuleKey(t *testing.T) {
 		})
 	}
 }
+
+func TestCleanRoutesOnNode(t *testing.T) {
+	ravenRoute := netlink.Route{
+		Dst:      netlink.NewIPNet([]byte{10, 10, 1, 0}),
+		Table:    9027,
+		Protocol: DefaultRouteProtocol,
+	}
+	otherRoute := netlink.Route{
+		Dst:      netlink.NewIPNet([]byte{10, 10, 2, 0}),
+		Table:    9027,
+		Protocol: unix.RTPROT_BOOT,
+	}
+	otherTableRoute := netlink.Route{
+		Dst:      netlink.NewIPNet([]byte{10, 10, 3, 0}),
+		Table:    254,
+		Protocol: DefaultRouteProtocol,
+	}
+	routesOnNode := []netlink.Route{ravenRoute, otherRoute, otherTableRoute}
+
+	defer func(listFn func(int, *netlink.Route, uint64) ([]netlink.Route, error), delFn func(*netlink.Route) error) {
+		netlinkutil.RouteListFiltered = listFn
+		netlinkutil.RouteDel = delFn
+	}(netlinkutil.RouteListFiltered, netlinkutil.RouteDel)
+	netlinkutil.RouteListFiltered = func(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+		routes := make([]netlink.Route, 0)
+		for _, v := range routesOnNode {
+			if filterMask&netlink.RT_FILTER_TABLE != 0 && v.Table != filter.Table {
+				continue
+			}
+			if filterMask&netlink.RT_FILTER_PROTOCOL != 0 && v.Protocol != filter.Protocol {
+				continue
+			}
+			routes = append(routes, v)
+		}
+		return routes, nil
+	}
+	deleted := make([]netlink.Route, 0)
+	netlinkutil.RouteDel = func(route *netlink.Route) error {
+		deleted = append(deleted, *route)
+		return nil
+	}
+
+	t.Logf("\tTestCase: %s", "only-raven-routes-are-deleted")
+	if err := CleanRoutesOnNode(9027, DefaultRouteProtocol); err != nil {
+		t.Fatalf("\t%s\texpect no error, but get %v", failed, err)
+	}
+	expect := []netlink.Route{ravenRoute}
+	if !reflect.DeepEqual(deleted, expect) {
+		t.Fatalf("\t%s\texpect %v, but get %v", failed, expect, deleted)
+	}
+	t.Logf("\t%s\texpect %v, get %v", succeed, expect, deleted)
+}
+
+func TestEnsureLinkType(t *testing.T) {
+	tests := []struct {
+		name      string
+		link      netlink.Link
+		linkType  string
+		expectErr bool
+	}{
+		{
+			name:     "same-type",
+			link:     &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "raven0"}},
+			linkType: "vxlan",
+		},
+		{
+			name:      "foreign-type",
+			link:      &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "raven0"}},
+			linkType:  "vxlan",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			t.Logf("\tTestCase: %s", tt.name)
+
+			err := EnsureLinkType(tt.link, tt.linkType)
+
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("\t%s\texpect error %v, but get %v", failed, tt.expectErr, err)
+			}
+			t.Logf("\t%s\texpect error %v, get %v", succeed, tt.expectErr, err)
+		})
+	}
+}
@@ -30,6 +30,8 @@ type Driver interface {
 	Apply(network *types.Network, routeDriverMTU func(*types.Network) (int, error)) error
 	// MTU return Minimal MTU in vpn driver
 	MTU() (int, error)
+	// Overhead returns the length of the headers the vpn driver adds to each packet.
+	Overhead() int
 	// Cleanup performs the necessary uninstallation.
 	Cleanup() error
 }
@@ -84,12 +86,19 @@ func FindCentralGwFn(network *types.Network) *types.Endpoint {
 		return candidates[i].NodeName < candidates[j].NodeName
 	})
 
-	var central *types.Endpoint
+	// Relay gateways are preferred, so that the central gateway is one of a known set of public gateways.
+	var central, relay *types.Endpoint
 	for i := range candidates {
 		if !candidates[i].UnderNAT {
 			central = candidates[i]
+			if candidates[i].Relay {
+				relay = candidates[i]
+			}
 		}
 	}
+	if relay != nil {
+		return relay
+	}
 	return central
 }
 
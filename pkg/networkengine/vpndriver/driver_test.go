@@ -31,6 +31,10 @@ func (TestDriver) MTU() (int, error) {
 	return 1, nil
 }
 
+func (TestDriver) Overhead() int {
+	return 0
+}
+
 func (TestDriver) Cleanup() error {
 	return nil
 }
@@ -108,6 +112,22 @@ func TestFindCentralGwFn(t *testing.T) {
 		RemoteNodeInfo:  make(map[types.NodeName]*v1alpha1.NodeInfo),
 	}
 
+	// gw-b is the last public gateway by node name, gw-a is preferred as a relay, gw-c is NATed.
+	relayed := &types.Network{
+		LocalEndpoint: &types.Endpoint{NodeName: "node-c", UnderNAT: true, Relay: true},
+		RemoteEndpoints: map[types.GatewayName]*types.Endpoint{
+			"gw-a": {NodeName: "node-a", Relay: true},
+			"gw-b": {NodeName: "node-b"},
+		},
+	}
+	noRelay := &types.Network{
+		LocalEndpoint: &types.Endpoint{NodeName: "node-c", UnderNAT: true, Relay: true},
+		RemoteEndpoints: map[types.GatewayName]*types.Endpoint{
+			"gw-a": {NodeName: "node-a"},
+			"gw-b": {NodeName: "node-b"},
+		},
+	}
+
 	tests := []struct {
 		name    string
 		network *types.Network
@@ -118,6 +138,16 @@ func TestFindCentralGwFn(t *testing.T) {
 			network: n,
 			expect:  n.LocalEndpoint,
 		},
+		{
+			name:    "prefer-relay",
+			network: relayed,
+			expect:  relayed.RemoteEndpoints["gw-a"],
+		},
+		{
+			name:    "NATed-relay-fallback",
+			network: noRelay,
+			expect:  noRelay.RemoteEndpoints["gw-b"],
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libreswan
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// DefaultFailureCooldown is the default time a connection is not retried once its breaker is open.
+const DefaultFailureCooldown = 5 * time.Minute
+
+var openBreakers = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "raven_libreswan_open_breakers",
+	Help: "Current number of libreswan connections not retried because they failed too many times in a row.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(openBreakers)
+}
+
+type breakerState struct {
+	failures int
+	// openedAt is when the connection failed threshold times in a row, zero if the breaker is closed.
+	openedAt time.Time
+}
+
+// connBreaker is a circuit breaker per connection. After threshold consecutive failures of a connection,
+// it is not retried until cooldown elapses. A nil connBreaker or a threshold of 0 never opens.
+type connBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	states    map[string]*breakerState
+}
+
+func newConnBreaker(threshold int, cooldown time.Duration) *connBreaker {
+	return &connBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		states:    make(map[string]*breakerState),
+	}
+}
+
+// allow returns whether the connection can be tried now, an open breaker allows one try once cooldown elapses.
+func (b *connBreaker) allow(name string) bool {
+	if b == nil || b.threshold <= 0 {
+		return true
+	}
+	s, ok := b.states[name]
+	if !ok || s.openedAt.IsZero() {
+		return true
+	}
+	return b.now().Sub(s.openedAt) >= b.cooldown
+}
+
+// retryAt returns when the connection is tried again, zero if its breaker is closed.
+func (b *connBreaker) retryAt(name string) time.Time {
+	if b == nil {
+		return time.Time{}
+	}
+	s, ok := b.states[name]
+	if !ok || s.openedAt.IsZero() {
+		return time.Time{}
+	}
+	return s.openedAt.Add(b.cooldown)
+}
+
+// failure records a failed try of the connection and opens the breaker after threshold consecutive failures.
+func (b *connBreaker) failure(name string) {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+	s, ok := b.states[name]
+	if !ok {
+		s = &breakerState{}
+		b.states[name] = s
+	}
+	s.failures++
+	if s.failures < b.threshold {
+		return
+	}
+	if s.openedAt.IsZero() {
+		klog.InfoS("connection failed too many times, stop retrying it for a while", "connectionName", name,
+			"failures", s.failures, "cooldown", b.cooldown)
+	}
+	// a failed try after cooldown opens the breaker again
+	s.openedAt = b.now()
+	b.observe()
+}
+
+// forget closes the breaker of the connection, either because it succeeded or it is no longer desired.
+func (b *connBreaker) forget(name string) {
+	if b == nil {
+		return
+	}
+	if s, ok := b.states[name]; ok && !s.openedAt.IsZero() {
+		klog.InfoS("closing the breaker of connection", "connectionName", name)
+	}
+	delete(b.states, name)
+	b.observe()
+}
+
+func (b *connBreaker) observe() {
+	open := 0
+	for _, s := range b.states {
+		if !s.openedAt.IsZero() {
+			open++
+		}
+	}
+	openBreakers.Set(float64(open))
+}
@@ -18,25 +18,50 @@ package libreswan
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/vdobler/ht/errorlist"
+	"github.com/vishvananda/netlink"
 	"k8s.io/klog/v2"
 
 	"github.com/openyurtio/raven/cmd/agent/app/config"
+	networkutil "github.com/openyurtio/raven/pkg/networkengine/util"
 	netlinkutil "github.com/openyurtio/raven/pkg/networkengine/util/netlink"
 	"github.com/openyurtio/raven/pkg/networkengine/vpndriver"
 	"github.com/openyurtio/raven/pkg/types"
+	"github.com/openyurtio/raven/pkg/utils"
 )
 
 const (
+	// IPSecEncapLen is the length of the ESP headers in tunnel mode with UDP encapsulation.
 	IPSecEncapLen = 64
+	// IPSecTransportEncapLen is IPSecEncapLen without the inner IP header, which transport mode does not add.
+	IPSecTransportEncapLen = IPSecEncapLen - 20
 
 	// DriverName specifies name of libreswan VPN backend driver.
 	DriverName = "libreswan"
+
+	// SuggestedDPDDelay is a dead peer detection interval suited to flaky edge links. Dead peer detection is
+	// disabled by default, so that upgrading does not change the connections.
+	SuggestedDPDDelay = 30 * time.Second
+	// DefaultDPDTimeout is the default time before an unresponsive peer is declared dead.
+	DefaultDPDTimeout = 150 * time.Second
+	// DefaultDPDAction restarts the connection when the peer is declared dead, so that tunnels self-heal.
+	DefaultDPDAction = "restart"
+
+	// TunnelMode encapsulates the traffic between the subnets of the gateways, it is the default mode.
+	TunnelMode = "tunnel"
+	// TransportMode only protects the traffic between the gateways themselves, so it is only supported by
+	// connections whose subnets are the addresses of the gateways, and not behind NAT.
+	TransportMode = "transport"
 )
 
 var _ vpndriver.Driver = (*libreswan)(nil)
@@ -45,17 +70,42 @@ var _ vpndriver.Driver = (*libreswan)(nil)
 var whackCmd = whackCmdFn
 var findCentralGw = vpndriver.FindCentralGwFn
 
+// proposalRegexp matches a libreswan proposal, e.g. "aes_gcm256-sha384;dh20".
+var proposalRegexp = regexp.MustCompile(`^[a-zA-Z0-9_]+([-;+][a-zA-Z0-9_]+)*$`)
+
 func init() {
 	vpndriver.RegisterDriver(DriverName, New)
 }
 
 const (
 	SecretFile string = "/etc/ipsec.d/raven.secrets"
+
+	whackPath = "/usr/libexec/ipsec/whack"
+	plutoPath = "/usr/local/bin/pluto"
+
+	// excludePolicyPriority takes precedence over the policies installed by pluto.
+	excludePolicyPriority = 0
 )
 
 type libreswan struct {
 	connections map[string]*vpndriver.Connection
 	nodeName    types.NodeName
+
+	// mode is the IPSec mode of connections, TunnelMode or TransportMode.
+	mode string
+	// ikeVersion is the IKE version of connections, 0 means the libreswan default.
+	ikeVersion int
+	// ikeProposals and espProposals are the proposals of connections, the libreswan defaults are used if empty.
+	ikeProposals []string
+	espProposals []string
+	// dpdDelay, dpdTimeout and dpdAction configure dead peer detection of connections, 0 dpdDelay disables it.
+	dpdDelay   time.Duration
+	dpdTimeout time.Duration
+	dpdAction  string
+	// breaker stops retrying connections that keep failing for a while.
+	breaker *connBreaker
+	// excludeCIDRs are the destinations that bypass the IPSec connections.
+	excludeCIDRs []*net.IPNet
 }
 
 func (l *libreswan) Init() error {
@@ -66,12 +116,18 @@ func (l *libreswan) Init() error {
 			return err
 		}
 	}
-	file, err := os.Create(SecretFile)
+	// The file holds the PSK, so it is only readable by pluto running as the same user.
+	file, err := os.OpenFile(SecretFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
 	if err != nil {
 		klog.Errorf("fail to create secrets file: %v", err)
 		return err
 	}
 	defer file.Close()
+	// OpenFile only sets the mode of a new file, so ensure it for an existing one too.
+	if err := file.Chmod(0o600); err != nil {
+		klog.Errorf("fail to chmod secrets file: %v", err)
+		return err
+	}
 
 	psk := vpndriver.GetPSK()
 	fmt.Fprintf(file, "%%any %%any : PSK \"%s\"\n", psk)
@@ -79,13 +135,91 @@ func (l *libreswan) Init() error {
 	return l.runPluto()
 }
 
+// Preflight checks the capability and the libreswan executables required by Init.
+func (l *libreswan) Preflight() error {
+	if err := networkutil.CheckNetAdmin(); err != nil {
+		return err
+	}
+	for _, path := range []string{plutoPath, whackPath} {
+		if err := networkutil.CheckExecutable(path); err != nil {
+			return fmt.Errorf("%s, libreswan must be installed in the agent image", err)
+		}
+	}
+	return nil
+}
+
 func New(cfg *config.Config) (vpndriver.Driver, error) {
+	excludeCIDRs, err := networkutil.ParseCIDRs(cfg.ExcludeCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing exclude cidrs: %s", err)
+	}
 	return &libreswan{
 		connections: make(map[string]*vpndriver.Connection),
 		nodeName:    types.NodeName(cfg.NodeName),
+
+		mode:         cfg.IPSecMode,
+		ikeVersion:   cfg.IPSecIKEVersion,
+		ikeProposals: cfg.IPSecIKEProposals,
+		espProposals: cfg.IPSecESPProposals,
+		dpdDelay:     cfg.IPSecDPDDelay,
+		dpdTimeout:   cfg.IPSecDPDTimeout,
+		dpdAction:    cfg.IPSecDPDAction,
+		breaker:      newConnBreaker(cfg.IPSecFailureThreshold, cfg.IPSecFailureCooldown),
+		excludeCIDRs: excludeCIDRs,
 	}, nil
 }
 
+// ValidateIKEVersion validates the IKE version of libreswan connections, 0 means the libreswan default.
+func ValidateIKEVersion(version int) error {
+	if version != 0 && version != 1 && version != 2 {
+		return fmt.Errorf("unsupported IKE version %d, must be 1 or 2", version)
+	}
+	return nil
+}
+
+// ValidateMode validates the IPSec mode of libreswan connections.
+func ValidateMode(mode string) error {
+	switch mode {
+	case TunnelMode, TransportMode:
+		return nil
+	}
+	return fmt.Errorf("unsupported IPSec mode %q, must be %s or %s", mode, TunnelMode, TransportMode)
+}
+
+// ValidateDPDDurations validates the dead peer detection delay and timeout of libreswan connections.
+// whack takes whole seconds, so a sub-second delay would become 0 and silently disable dead peer detection.
+func ValidateDPDDurations(delay, timeout time.Duration) error {
+	if delay < 0 || timeout < 0 {
+		return fmt.Errorf("must not be negative")
+	}
+	if delay == 0 {
+		return nil
+	}
+	if delay%time.Second != 0 || timeout%time.Second != 0 || timeout == 0 {
+		return fmt.Errorf("must be a positive number of whole seconds, got delay %s and timeout %s", delay, timeout)
+	}
+	return nil
+}
+
+// ValidateDPDAction validates the dead peer detection action of libreswan connections.
+func ValidateDPDAction(action string) error {
+	switch action {
+	case "clear", "hold", "restart":
+		return nil
+	}
+	return fmt.Errorf("unsupported dead peer detection action %q, must be one of clear, hold and restart", action)
+}
+
+// ValidateProposals validates the IKE or ESP proposals of libreswan connections.
+func ValidateProposals(proposals []string) error {
+	for _, v := range proposals {
+		if !proposalRegexp.MatchString(v) {
+			return fmt.Errorf("malformed proposal %q", v)
+		}
+	}
+	return nil
+}
+
 func (l *libreswan) Apply(network *types.Network, routeDriverMTUFn func(*types.Network) (int, error)) (err error) {
 	errList := errorlist.List{}
 	if network.LocalEndpoint == nil || len(network.RemoteEndpoints) == 0 {
@@ -102,6 +236,17 @@ func (l *libreswan) Apply(network *types.Network, routeDriverMTUFn func(*types.N
 		klog.Infof("no desired connections, cleaning vpn connections")
 		return l.Cleanup()
 	}
+	// The topology is only known here. The connections not supporting transport mode are not made, while the
+	// others are kept, and the error is not fixed by retrying until the gateways are changed.
+	if l.mode == TransportMode {
+		if err := removeTransportModeUnsupported(desiredConnections); err != nil {
+			klog.ErrorS(err, "skipping connections not supporting transport mode")
+			errList = errList.Append(utils.NewPermanentError(err))
+		}
+	}
+
+	// the policies are flushed by Cleanup, so that they are ensured on every apply.
+	errList = errList.Append(l.ensureExcludePolicies())
 
 	// remove unwanted connections
 	for connName := range l.connections {
@@ -115,6 +260,7 @@ func (l *libreswan) Apply(network *types.Network, routeDriverMTUFn func(*types.N
 			delete(l.connections, connName)
 		}
 	}
+	l.forgetFailures(desiredConnections)
 
 	// add new connections
 	for name, connection := range desiredConnections {
@@ -125,12 +271,49 @@ func (l *libreswan) Apply(network *types.Network, routeDriverMTUFn func(*types.N
 	return errList.AsError()
 }
 
+// ensureExcludePolicies installs the xfrm policies that allow the traffic of the excluded destinations in
+// plain text. XFRM policies are looked up regardless of the route tables, so the throw routes of the route
+// driver cannot keep the traffic out of the IPSec connections.
+//
+//	ip xfrm policy update src {any} dst {exclude_cidr} dir out priority 0 action allow
+//	ip xfrm policy update src {exclude_cidr} dst {any} dir {in,fwd} priority 0 action allow
+func (l *libreswan) ensureExcludePolicies() errorlist.List {
+	errList := errorlist.List{}
+	for _, cidr := range l.excludeCIDRs {
+		anyNet := &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 8*net.IPv4len)}
+		if cidr.IP.To4() == nil {
+			anyNet = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)}
+		}
+		policies := []*netlink.XfrmPolicy{
+			{Src: anyNet, Dst: cidr, Dir: netlink.XFRM_DIR_OUT},
+			{Src: cidr, Dst: anyNet, Dir: netlink.XFRM_DIR_IN},
+			{Src: cidr, Dst: anyNet, Dir: netlink.XFRM_DIR_FWD},
+		}
+		for _, policy := range policies {
+			policy.Priority = excludePolicyPriority
+			policy.Action = netlink.XFRM_POLICY_ALLOW
+			if err := netlinkutil.XfrmPolicyUpdate(policy); err != nil {
+				errList = errList.Append(fmt.Errorf("error updating xfrm policy of exclude cidr %s: %s", cidr, err))
+			}
+		}
+	}
+	return errList
+}
+
 func (l *libreswan) MTU() (int, error) {
 	mtu, err := vpndriver.DefaultMTU()
 	if err != nil {
 		return 0, err
 	}
-	return mtu - IPSecEncapLen, nil
+	return mtu - l.Overhead(), nil
+}
+
+// Overhead returns the length of the ESP headers with UDP encapsulation in the configured mode.
+func (l *libreswan) Overhead() int {
+	if l.mode == TransportMode {
+		return IPSecTransportEncapLen
+	}
+	return IPSecEncapLen
 }
 
 // getEndpointResolver returns a function that resolve the left subnets and the Endpoint that should connect to.
@@ -187,30 +370,34 @@ func (l *libreswan) whackConnectToEndpoint(connectionName string, connection *vp
 		args = append(args, "--psk", "--encrypt", "--forceencaps", "--name", connectionName,
 			"--id", leftID,
 			"--host", connection.LocalEndpoint.String(),
-			"--client", connection.LocalSubnet,
-			"--ikeport", "4500",
 		)
+		args = append(args, l.clientArgs(connection.LocalSubnet)...)
+		args = append(args, "--ikeport", "4500")
 	} else {
 		args = append(args, "--psk", "--encrypt", "--forceencaps", "--name", connectionName,
 			"--id", leftID,
 			"--host", connection.LocalEndpoint.String(),
-			"--client", connection.LocalSubnet,
 		)
+		args = append(args, l.clientArgs(connection.LocalSubnet)...)
 	}
 	// remote
 	if !connection.RemoteEndpoint.UnderNAT {
 		args = append(args, "--to",
 			"--id", rightID,
 			"--host", connection.RemoteEndpoint.PublicIP,
-			"--client", connection.RemoteSubnet,
-			"--ikeport", "4500")
+		)
+		args = append(args, l.clientArgs(connection.RemoteSubnet)...)
+		args = append(args, "--ikeport", "4500")
 	} else {
 		args = append(args, "--to",
 			"--id", rightID,
 			"--host", "%any",
-			"--client", connection.RemoteSubnet)
+		)
+		args = append(args, l.clientArgs(connection.RemoteSubnet)...)
 	}
 
+	args = append(args, l.connectionOptions()...)
+
 	if err := whackCmd(args...); err != nil {
 		return err
 	}
@@ -225,6 +412,82 @@ func (l *libreswan) whackConnectToEndpoint(connectionName string, connection *vp
 	return nil
 }
 
+// clientArgs returns the whack arguments of the subnet behind an end of a connection. In transport mode the subnet
+// is the address of the gateway, which is the default client of the end, so that it is not set.
+func (l *libreswan) clientArgs(subnet string) []string {
+	if l.mode == TransportMode {
+		return nil
+	}
+	return []string{"--client", subnet}
+}
+
+// transportModeErr returns why the connection does not support transport mode, nil if it does.
+// Transport mode only protects the traffic between the --host addresses of the ends, which are the private IP of
+// the local gateway and the public IP of the remote gateway, so the subnets must be exactly these addresses.
+// An end behind NAT has no fixed --host address.
+func transportModeErr(connection *vpndriver.Connection) error {
+	if connection.LocalEndpoint.UnderNAT || connection.RemoteEndpoint.UnderNAT {
+		return fmt.Errorf("gateway %s or %s is behind NAT", connection.LocalEndpoint.GatewayName, connection.RemoteEndpoint.GatewayName)
+	}
+	localHost, remoteHost := connection.LocalEndpoint.String(), connection.RemoteEndpoint.PublicIP
+	if !isHostSubnet(connection.LocalSubnet, localHost) || !isHostSubnet(connection.RemoteSubnet, remoteHost) {
+		return fmt.Errorf("subnets %s and %s are not the addresses %s and %s of the gateways",
+			connection.LocalSubnet, connection.RemoteSubnet, localHost, remoteHost)
+	}
+	return nil
+}
+
+// removeTransportModeUnsupported removes the connections not supporting transport mode from conns, and returns
+// their errors in the order of their names.
+func removeTransportModeUnsupported(conns map[string]*vpndriver.Connection) error {
+	names := make([]string, 0, len(conns))
+	for name := range conns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errList := errorlist.List{}
+	for _, name := range names {
+		if err := transportModeErr(conns[name]); err != nil {
+			errList = errList.Append(fmt.Errorf("connection %s does not support %s mode: %s", name, TransportMode, err))
+			delete(conns, name)
+		}
+	}
+	return errList.AsError()
+}
+
+func isHostSubnet(subnet, ip string) bool {
+	addr, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return false
+	}
+	ones, bits := ipNet.Mask.Size()
+	return ones == bits && addr.Equal(net.ParseIP(ip))
+}
+
+// connectionOptions returns the whack arguments of the configured IKE version, proposals and dead peer detection.
+func (l *libreswan) connectionOptions() []string {
+	args := make([]string, 0)
+	switch l.ikeVersion {
+	case 1:
+		args = append(args, "--ikev1")
+	case 2:
+		args = append(args, "--ikev2")
+	}
+	if len(l.ikeProposals) != 0 {
+		args = append(args, "--ike", strings.Join(l.ikeProposals, ","))
+	}
+	if len(l.espProposals) != 0 {
+		args = append(args, "--esp", strings.Join(l.espProposals, ","))
+	}
+	if l.dpdDelay > 0 {
+		args = append(args,
+			"--dpddelay", strconv.Itoa(int(l.dpdDelay.Seconds())),
+			"--dpdtimeout", strconv.Itoa(int(l.dpdTimeout.Seconds())),
+			"--dpdaction", l.dpdAction)
+	}
+	return args
+}
+
 func (l *libreswan) computeDesiredConnections(network *types.Network) map[string]*vpndriver.Connection {
 	centralGw := findCentralGw(network)
 	resolveEndpoint := l.getEndpointResolver(network)
@@ -253,7 +516,7 @@ func whackCmdFn(args ...string) error {
 	var err error
 	var output []byte
 	for i := 0; i < 5; i++ {
-		cmd := exec.Command("/usr/libexec/ipsec/whack", args...)
+		cmd := exec.Command(whackPath, args...)
 		output, err = cmd.CombinedOutput()
 		if err == nil {
 			klog.InfoS("whacking with", "args", args, "output", string(output))
@@ -284,6 +547,7 @@ func (l *libreswan) Cleanup() error {
 		}
 	}
 	l.connections = make(map[string]*vpndriver.Connection)
+	l.forgetFailures(nil)
 	err := netlinkutil.XfrmPolicyFlush()
 	errList = errList.Append(err)
 	return errList.AsError()
@@ -292,7 +556,7 @@ func (l *libreswan) Cleanup() error {
 func (l *libreswan) runPluto() error {
 	klog.Info("starting pluto")
 
-	cmd := exec.Command("/usr/local/bin/pluto")
+	cmd := exec.Command(plutoPath)
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Pdeathsig: syscall.SIGTERM,
@@ -329,12 +593,33 @@ func (l *libreswan) connectToEndpoint(name string, connection *vpndriver.Connect
 		klog.InfoS("skipping connect because connection already exists", "connectionName", name)
 		return errList
 	}
+	// The connection is not established, so the sync fails and the agent is not reported ready. The error is
+	// permanent, as retrying before cooldown elapses would be skipped again.
+	if !l.breaker.allow(name) {
+		klog.InfoS("skipping connect because connection failed too many times", "connectionName", name)
+		return errList.Append(utils.NewPermanentError(fmt.Errorf("connection %s not retried until %s",
+			name, l.breaker.retryAt(name).Format(time.RFC3339))))
+	}
 	err := l.whackConnectToEndpoint(name, connection)
 	if err != nil {
+		l.breaker.failure(name)
 		errList = errList.Append(err)
 		klog.ErrorS(err, "error connect connection", "connectionName", name)
 		return errList
 	}
+	l.breaker.forget(name)
 	l.connections[name] = connection
 	return errList
 }
+
+// forgetFailures closes the breakers of the connections that are not desired anymore.
+func (l *libreswan) forgetFailures(desiredConnections map[string]*vpndriver.Connection) {
+	if l.breaker == nil {
+		return
+	}
+	for name := range l.breaker.states {
+		if _, ok := desiredConnections[name]; !ok {
+			l.breaker.forget(name)
+		}
+	}
+}
@@ -20,12 +20,16 @@ import (
 	"errors"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
 
+	networkutil "github.com/openyurtio/raven/pkg/networkengine/util"
 	netlinkutil "github.com/openyurtio/raven/pkg/networkengine/util/netlink"
 	"github.com/openyurtio/raven/pkg/networkengine/vpndriver"
 	"github.com/openyurtio/raven/pkg/types"
+	"github.com/openyurtio/raven/pkg/utils"
 )
 
 type whackMock struct {
@@ -384,3 +388,436 @@ func TestLibreswan_Apply(t *testing.T) {
 		})
 	}
 }
+
+func TestLibreswan_ConnectionOptions(t *testing.T) {
+	connection := &vpndriver.Connection{
+		LocalEndpoint: &types.Endpoint{
+			GatewayName: "localGw",
+			NodeName:    "localGwNode",
+			PrivateIP:   "192.168.0.1",
+			PublicIP:    "1.1.1.1",
+		},
+		RemoteEndpoint: &types.Endpoint{
+			GatewayName: "remoteGw",
+			NodeName:    "remoteGwNode",
+			PrivateIP:   "192.168.0.2",
+			PublicIP:    "1.1.1.2",
+		},
+		LocalSubnet:  "10.244.0.0/24",
+		RemoteSubnet: "10.244.2.0/24",
+	}
+	testcases := []struct {
+		name         string
+		libreswan    *libreswan
+		expectedArgs []string
+		absentArgs   []string
+	}{
+		{
+			name:       "defaults",
+			libreswan:  &libreswan{},
+			absentArgs: []string{"--ikev1", "--ikev2", "--ike ", "--esp ", "--dpddelay"},
+		},
+		{
+			name: "ikev2-with-proposals",
+			libreswan: &libreswan{
+				ikeVersion:   2,
+				ikeProposals: []string{"aes_gcm256-sha384;dh20", "aes256-sha2_512;modp2048"},
+				espProposals: []string{"aes_gcm256"},
+			},
+			expectedArgs: []string{"--ikev2", "--ike aes_gcm256-sha384;dh20,aes256-sha2_512;modp2048", "--esp aes_gcm256"},
+			absentArgs:   []string{"--ikev1"},
+		},
+		{
+			name: "dead-peer-detection",
+			libreswan: &libreswan{
+				dpdDelay:   SuggestedDPDDelay,
+				dpdTimeout: DefaultDPDTimeout,
+				dpdAction:  DefaultDPDAction,
+			},
+			expectedArgs: []string{"--dpddelay 30", "--dpdtimeout 150", "--dpdaction restart"},
+		},
+		{
+			name: "dead-peer-detection-disabled",
+			libreswan: &libreswan{
+				dpdTimeout: DefaultDPDTimeout,
+				dpdAction:  DefaultDPDAction,
+			},
+			absentArgs: []string{"--dpddelay", "--dpdtimeout", "--dpdaction"},
+		},
+	}
+	for _, v := range testcases {
+		t.Run(v.name, func(t *testing.T) {
+			w := &whackMock{}
+			whackCmd = w.whackCmd
+			a := assert.New(t)
+			a.NoError(v.libreswan.whackConnectToEndpoint("conn", connection))
+			a.NotEmpty(w.cmdHistory)
+			for _, arg := range v.expectedArgs {
+				a.Contains(w.cmdHistory[0], arg)
+			}
+			for _, arg := range v.absentArgs {
+				a.NotContains(w.cmdHistory[0], arg)
+			}
+		})
+	}
+}
+
+func TestValidateProposals(t *testing.T) {
+	a := assert.New(t)
+	a.NoError(ValidateProposals(nil))
+	a.NoError(ValidateProposals([]string{"aes_gcm256-sha384;dh20", "aes256-sha2_512+sha2_256-modp2048"}))
+	a.Error(ValidateProposals([]string{"aes256 sha1"}))
+	a.Error(ValidateProposals([]string{"aes256-"}))
+	a.Error(ValidateProposals([]string{""}))
+	a.NoError(ValidateIKEVersion(0))
+	a.NoError(ValidateIKEVersion(2))
+	a.Error(ValidateIKEVersion(3))
+	a.NoError(ValidateDPDAction("restart"))
+	a.Error(ValidateDPDAction("reset"))
+	a.NoError(ValidateDPDDurations(SuggestedDPDDelay, DefaultDPDTimeout))
+	a.NoError(ValidateDPDDurations(0, 0))
+	a.Error(ValidateDPDDurations(500*time.Millisecond, DefaultDPDTimeout))
+	a.Error(ValidateDPDDurations(SuggestedDPDDelay, 1500*time.Millisecond))
+	a.Error(ValidateDPDDurations(SuggestedDPDDelay, 0))
+	a.Error(ValidateDPDDurations(-time.Second, DefaultDPDTimeout))
+	a.NoError(ValidateMode(TransportMode))
+	a.Error(ValidateMode("beet"))
+}
+
+func TestLibreswan_Overhead(t *testing.T) {
+	assert.Equal(t, IPSecEncapLen, (&libreswan{}).Overhead())
+	assert.Equal(t, IPSecEncapLen, (&libreswan{mode: TunnelMode}).Overhead())
+	assert.Equal(t, IPSecTransportEncapLen, (&libreswan{mode: TransportMode}).Overhead())
+}
+
+func TestLibreswan_Mode(t *testing.T) {
+	newConnection := func(localSubnet, remoteSubnet string, remoteUnderNAT bool) *vpndriver.Connection {
+		return &vpndriver.Connection{
+			LocalEndpoint: &types.Endpoint{
+				GatewayName: "localGw",
+				NodeName:    "localGwNode",
+				PrivateIP:   "192.168.0.1",
+				PublicIP:    "1.1.1.1",
+			},
+			RemoteEndpoint: &types.Endpoint{
+				GatewayName: "remoteGw",
+				NodeName:    "remoteGwNode",
+				PrivateIP:   "192.168.0.2",
+				PublicIP:    "1.1.1.2",
+				UnderNAT:    remoteUnderNAT,
+			},
+			LocalSubnet:  localSubnet,
+			RemoteSubnet: remoteSubnet,
+		}
+	}
+	testcases := []struct {
+		name         string
+		mode         string
+		connection   *vpndriver.Connection
+		expectedArgs []string
+		absentArgs   []string
+		// unsupported is true if the connection does not support transport mode.
+		unsupported bool
+	}{
+		{
+			name:         "tunnel",
+			mode:         TunnelMode,
+			connection:   newConnection("10.244.0.0/24", "10.244.2.0/24", false),
+			expectedArgs: []string{"--client 10.244.0.0/24", "--client 10.244.2.0/24"},
+		},
+		{
+			name:         "transport",
+			mode:         TransportMode,
+			connection:   newConnection("192.168.0.1/32", "1.1.1.2/32", false),
+			expectedArgs: []string{"--host 192.168.0.1", "--host 1.1.1.2"},
+			absentArgs:   []string{"--client"},
+		},
+		{
+			// the remote --host is its public ip, so the transport mode sa would not cover its private ip.
+			name:        "transport-to-remote-private-ip",
+			mode:        TransportMode,
+			connection:  newConnection("192.168.0.1/32", "192.168.0.2/32", false),
+			unsupported: true,
+		},
+		{
+			name:        "transport-between-subnets",
+			mode:        TransportMode,
+			connection:  newConnection("10.244.0.0/24", "10.244.2.0/24", false),
+			unsupported: true,
+		},
+		{
+			name:        "transport-under-nat",
+			mode:        TransportMode,
+			connection:  newConnection("192.168.0.1/32", "1.1.1.2/32", true),
+			unsupported: true,
+		},
+	}
+	for _, v := range testcases {
+		t.Run(v.name, func(t *testing.T) {
+			w := &whackMock{}
+			whackCmd = w.whackCmd
+			a := assert.New(t)
+			if v.unsupported {
+				a.Error(transportModeErr(v.connection))
+				return
+			}
+			a.NoError((&libreswan{mode: v.mode}).whackConnectToEndpoint("conn", v.connection))
+			a.NotEmpty(w.cmdHistory)
+			for _, arg := range v.expectedArgs {
+				a.Contains(w.cmdHistory[0], arg)
+			}
+			for _, arg := range v.absentArgs {
+				a.NotContains(w.cmdHistory[0], arg)
+			}
+		})
+	}
+}
+
+func TestLibreswan_ConnectBreaker(t *testing.T) {
+	a := assert.New(t)
+	var tries int
+	whackCmd = func(args ...string) error {
+		tries++
+		return errors.New("whack failed")
+	}
+	now := time.Unix(0, 0)
+	l := &libreswan{
+		connections: make(map[string]*vpndriver.Connection),
+		breaker:     newConnBreaker(2, time.Minute),
+	}
+	l.breaker.now = func() time.Time { return now }
+	conn := &vpndriver.Connection{
+		LocalEndpoint:  &types.Endpoint{PrivateIP: "192.168.0.1"},
+		RemoteEndpoint: &types.Endpoint{PrivateIP: "192.168.0.2"},
+	}
+
+	// the breaker opens after 2 failures in a row
+	a.Error(l.connectToEndpoint("conn", conn).AsError())
+	a.Error(l.connectToEndpoint("conn", conn).AsError())
+	err := l.connectToEndpoint("conn", conn).AsError()
+	a.True(utils.IsPermanentError(err), "connection skipped by an open breaker should fail permanently")
+	a.Contains(err.Error(), "not retried until")
+	a.Equal(2, tries)
+
+	// one try is allowed once cooldown elapses, and a failure opens the breaker again
+	now = now.Add(time.Minute)
+	a.Error(l.connectToEndpoint("conn", conn).AsError())
+	a.True(utils.IsPermanentError(l.connectToEndpoint("conn", conn).AsError()))
+	a.Equal(3, tries)
+
+	// a success closes the breaker
+	now = now.Add(time.Minute)
+	whackCmd = (&whackMock{}).whackCmd
+	a.NoError(l.connectToEndpoint("conn", conn).AsError())
+	a.Contains(l.connections, "conn")
+	a.Empty(l.breaker.states)
+
+	// breakers of connections not desired anymore are closed
+	l.breaker.failure("stale")
+	l.forgetFailures(map[string]*vpndriver.Connection{"conn": conn})
+	a.Empty(l.breaker.states)
+}
+
+func TestLibreswan_ApplyBreakerOpen(t *testing.T) {
+	a := assert.New(t)
+	netlinkutil.XfrmPolicyFlush = func() error { return nil }
+	findCentralGw = vpndriver.FindCentralGwFn
+	whackCmd = func(args ...string) error {
+		return errors.New("whack failed")
+	}
+	l := &libreswan{
+		connections: make(map[string]*vpndriver.Connection),
+		nodeName:    "localGwNode",
+		breaker:     newConnBreaker(1, time.Hour),
+	}
+	network := &types.Network{
+		LocalEndpoint: &types.Endpoint{
+			GatewayName: "localGw",
+			NodeName:    "localGwNode",
+			Subnets:     []string{"10.244.0.0/24"},
+			PrivateIP:   "192.168.0.1",
+			PublicIP:    "1.1.1.1",
+		},
+		RemoteEndpoints: map[types.GatewayName]*types.Endpoint{
+			"remoteGw": {
+				GatewayName: "remoteGw",
+				NodeName:    "remoteGwNode",
+				Subnets:     []string{"10.244.1.0/24"},
+				PrivateIP:   "192.168.0.2",
+				PublicIP:    "1.1.1.2",
+			},
+		},
+	}
+	err := l.Apply(network, nil)
+	a.Error(err)
+	a.False(utils.IsPermanentError(err))
+
+	// the connection is still not established while the breaker is open, so Apply must not succeed.
+	err = l.Apply(network, nil)
+	a.Error(err)
+	a.True(utils.IsPermanentError(err))
+	a.Empty(l.connections)
+}
+
+func TestLibreswan_ApplySubnetChange(t *testing.T) {
+	a := assert.New(t)
+	netlinkutil.XfrmPolicyFlush = func() error { return nil }
+	network := func(remoteSubnets ...string) *types.Network {
+		return &types.Network{
+			LocalEndpoint: &types.Endpoint{
+				GatewayName: "localGw",
+				NodeName:    "localGwNode",
+				Subnets:     []string{"10.244.0.0/24"},
+				PrivateIP:   "192.168.0.1",
+				PublicIP:    "1.1.1.1",
+			},
+			RemoteEndpoints: map[types.GatewayName]*types.Endpoint{
+				"remoteGw": {
+					GatewayName: "remoteGw",
+					NodeName:    "remoteGwNode",
+					Subnets:     remoteSubnets,
+					PrivateIP:   "192.168.0.2",
+					PublicIP:    "1.1.1.2",
+				},
+			},
+		}
+	}
+	findCentralGw = vpndriver.FindCentralGwFn
+	w := &whackMock{}
+	whackCmd = w.whackCmd
+	l := &libreswan{
+		connections: make(map[string]*vpndriver.Connection),
+		nodeName:    "localGwNode",
+	}
+	kept := connectionName("192.168.0.1", "192.168.0.2", "10.244.0.0/24", "10.244.1.0/24")
+	changed := connectionName("192.168.0.1", "192.168.0.2", "10.244.0.0/24", "10.244.2.0/24")
+	a.NoError(l.Apply(network("10.244.1.0/24"), nil))
+
+	// adding a subnet only adds the connection of the new subnet.
+	w.cmdHistory = nil
+	a.NoError(l.Apply(network("10.244.1.0/24", "10.244.2.0/24"), nil))
+	a.Contains(w.connections, kept)
+	a.Contains(w.connections, changed)
+	for _, cmd := range w.cmdHistory {
+		a.NotContains(cmd, kept, "connection of the unchanged subnet should be kept")
+	}
+
+	// removing a subnet only deletes the connection of the removed subnet.
+	w.cmdHistory = nil
+	a.NoError(l.Apply(network("10.244.1.0/24"), nil))
+	a.Contains(w.connections, kept)
+	a.NotContains(w.connections, changed)
+	a.Equal([]string{"--delete --name " + changed}, w.cmdHistory)
+}
+
+func TestLibreswan_ExcludePolicies(t *testing.T) {
+	a := assert.New(t)
+	netlinkutil.XfrmPolicyFlush = func() error { return nil }
+	var policies []*netlink.XfrmPolicy
+	netlinkutil.XfrmPolicyUpdate = func(policy *netlink.XfrmPolicy) error {
+		policies = append(policies, policy)
+		return nil
+	}
+	findCentralGw = vpndriver.FindCentralGwFn
+	w := &whackMock{}
+	whackCmd = w.whackCmd
+	excludeCIDRs, err := networkutil.ParseCIDRs([]string{"10.244.1.128/25"})
+	a.NoError(err)
+	l := &libreswan{
+		connections:  make(map[string]*vpndriver.Connection),
+		nodeName:     "localGwNode",
+		excludeCIDRs: excludeCIDRs,
+	}
+	network := &types.Network{
+		LocalEndpoint: &types.Endpoint{
+			GatewayName: "localGw",
+			NodeName:    "localGwNode",
+			Subnets:     []string{"10.244.0.0/24"},
+			PrivateIP:   "192.168.0.1",
+			PublicIP:    "1.1.1.1",
+		},
+		RemoteEndpoints: map[types.GatewayName]*types.Endpoint{
+			"remoteGw": {
+				GatewayName: "remoteGw",
+				NodeName:    "remoteGwNode",
+				Subnets:     []string{"10.244.1.0/24"},
+				PrivateIP:   "192.168.0.2",
+				PublicIP:    "1.1.1.2",
+			},
+		},
+	}
+	a.NoError(l.Apply(network, nil))
+	a.Len(w.connections, 1)
+	// the excluded destination bypasses the connection in every direction.
+	dirs := make(map[netlink.Dir]bool)
+	for _, policy := range policies {
+		a.Equal(netlink.XFRM_POLICY_ALLOW, policy.Action)
+		a.Equal(excludePolicyPriority, policy.Priority)
+		if policy.Dir == netlink.XFRM_DIR_OUT {
+			a.Equal("10.244.1.128/25", policy.Dst.String())
+			a.Equal("0.0.0.0/0", policy.Src.String())
+		} else {
+			a.Equal("10.244.1.128/25", policy.Src.String())
+			a.Equal("0.0.0.0/0", policy.Dst.String())
+		}
+		dirs[policy.Dir] = true
+	}
+	a.Equal(map[netlink.Dir]bool{netlink.XFRM_DIR_OUT: true, netlink.XFRM_DIR_IN: true, netlink.XFRM_DIR_FWD: true}, dirs)
+}
+
+func TestLibreswan_ApplyTransportMode(t *testing.T) {
+	a := assert.New(t)
+	var cleanup bool
+	netlinkutil.XfrmPolicyFlush = func() error {
+		cleanup = true
+		return nil
+	}
+	findCentralGw = vpndriver.FindCentralGwFn
+	w := &whackMock{}
+	whackCmd = w.whackCmd
+	l := &libreswan{
+		connections: make(map[string]*vpndriver.Connection),
+		nodeName:    "localGwNode",
+		mode:        TransportMode,
+	}
+	network := &types.Network{
+		LocalEndpoint: &types.Endpoint{
+			GatewayName: "localGw",
+			NodeName:    "localGwNode",
+			Subnets:     []string{"10.244.0.0/24"},
+			PrivateIP:   "192.168.0.1",
+			PublicIP:    "1.1.1.1",
+		},
+		RemoteEndpoints: map[types.GatewayName]*types.Endpoint{
+			"remoteGw": {
+				GatewayName: "remoteGw",
+				NodeName:    "remoteGwNode",
+				Subnets:     []string{"10.244.1.0/24"},
+				PrivateIP:   "192.168.0.2",
+				PublicIP:    "1.1.1.2",
+			},
+		},
+	}
+
+	// the pod subnets of the gateways do not support transport mode, so no connection is made.
+	err := l.Apply(network, nil)
+	a.True(utils.IsPermanentError(err))
+	a.Contains(err.Error(), "subnets 10.244.0.0/24 and 10.244.1.0/24 are not the addresses 192.168.0.1 and 1.1.1.2 of the gateways")
+	a.Empty(w.connections)
+
+	// the host-to-host subnets support transport mode, their connection is made besides the unsupported one.
+	network.LocalEndpoint.Subnets = append(network.LocalEndpoint.Subnets, "192.168.0.1/32")
+	network.RemoteEndpoints["remoteGw"].Subnets = append(network.RemoteEndpoints["remoteGw"].Subnets, "1.1.1.2/32")
+	hostToHost := connectionName("192.168.0.1", "192.168.0.2", "192.168.0.1/32", "1.1.1.2/32")
+	err = l.Apply(network, nil)
+	a.True(utils.IsPermanentError(err))
+	a.Len(w.connections, 1)
+	a.Contains(w.connections, hostToHost)
+
+	// the unsupported connections do not tear down the supported ones on the next sync.
+	w.cmdHistory = nil
+	a.True(utils.IsPermanentError(l.Apply(network, nil)))
+	a.Contains(w.connections, hostToHost)
+	a.Empty(w.cmdHistory)
+	a.False(cleanup)
+}
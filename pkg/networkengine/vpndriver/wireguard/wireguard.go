@@ -23,14 +23,19 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"sort"
 	"time"
 
 	"github.com/openyurtio/openyurt/pkg/apis/raven/v1alpha1"
 	"github.com/pkg/errors"
 	"github.com/vdobler/ht/errorlist"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -39,6 +44,7 @@ import (
 	networkutil "github.com/openyurtio/raven/pkg/networkengine/util"
 	"github.com/openyurtio/raven/pkg/networkengine/vpndriver"
 	"github.com/openyurtio/raven/pkg/types"
+	"github.com/openyurtio/raven/pkg/utils"
 )
 
 const (
@@ -51,13 +57,16 @@ const (
 	DriverName = "wireguard"
 	// PublicKey is name (key) of publicKey entry in back-end map.
 	PublicKey = "publicKey"
-	// KeepAliveInterval to use for wg peers.
+	// KeepAliveInterval is the default keepalive interval to use for wg peers, the interval used before it is configurable.
 	KeepAliveInterval = 5 * time.Second
 
 	// DeviceName specifies name of WireGuard network device.
 	DeviceName = "raven-wg0"
 	// ListenPort specifies port of WireGuard listened.
 	ListenPort = 4500
+
+	// EventPeerConflict is the event reason indicating peers are removed because their allowed IPs overlap.
+	EventPeerConflict = "PeerConflict"
 )
 
 var findCentralGw = vpndriver.FindCentralGwFn
@@ -77,16 +86,46 @@ type wireguard struct {
 	connections map[string]*vpndriver.Connection
 	nodeName    types.NodeName
 	ravenClient client.Client
+	recorder    record.EventRecorder
+	// keepAliveInterval is the persistent keepalive interval of peers, 0 disables it.
+	keepAliveInterval time.Duration
+	// routeProtocol is the protocol of routes added by the driver, so that cleanup only deletes them.
+	routeProtocol netlink.RouteProtocol
+	// mtu is the explicit MTU of the WireGuard device, 0 means computing it from the default route link.
+	mtu int
+	// updateBackoff is the backoff of retrying conflicting Gateway updates.
+	updateBackoff wait.Backoff
+	// excludeCIDRs are the destinations that are not routed through the WireGuard device.
+	excludeCIDRs []*net.IPNet
 }
 
 func New(cfg *config.Config) (vpndriver.Driver, error) {
+	excludeCIDRs, err := networkutil.ParseCIDRs(cfg.ExcludeCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing exclude cidrs: %s", err)
+	}
 	return &wireguard{
 		connections: make(map[string]*vpndriver.Connection),
 		nodeName:    types.NodeName(cfg.NodeName),
 		ravenClient: cfg.Manager.GetClient(),
+		recorder:    cfg.Manager.GetEventRecorderFor("raven-agent"),
+
+		keepAliveInterval: cfg.WireGuardKeepAliveInterval,
+		mtu:               cfg.WireGuardMTU,
+		routeProtocol:     networkutil.RouteProtocol(cfg.RouteProtocol),
+		updateBackoff:     cfg.GatewayUpdateBackoff(),
+		excludeCIDRs:      excludeCIDRs,
 	}, nil
 }
 
+// Preflight checks the capability and the kernel module required by the WireGuard device.
+func (w *wireguard) Preflight() error {
+	if err := networkutil.CheckNetAdmin(); err != nil {
+		return err
+	}
+	return networkutil.CheckKernelModule(wgLinkType, unix.WG_GENL_NAME)
+}
+
 func (w *wireguard) Init() error {
 	var err error
 	// Create the WireGuard controller.
@@ -111,6 +150,13 @@ func (w *wireguard) Init() error {
 		return fmt.Errorf("error get pre-shared key: %v", err)
 	}
 
+	// Reuse the key of the device left by the previous agent, e.g. with --preserve-on-exit, so that the device and
+	// its peers are adopted by Apply as they are, instead of every peer waiting for a new public key.
+	if d, err := w.wgClient.Device(DeviceName); err == nil && d.PrivateKey != (wgtypes.Key{}) {
+		klog.InfoS("reusing the private key of the existing wireguard device", "device", DeviceName)
+		w.privateKey = d.PrivateKey
+		return nil
+	}
 	if w.privateKey, err = wgtypes.GeneratePrivateKey(); err != nil {
 		return fmt.Errorf("error generating private key: %v", err)
 	}
@@ -156,10 +202,14 @@ func (w *wireguard) ensureWgLink(network *types.Network, routeDriverMTUFn func(*
 		LinkType:  wgLinkType,
 	}
 
-	// Delete existing wg link if needed
+	// Reuse the existing wg link unless its attributes changed. A link of another type with the same name
+	// is not created by raven, so it is neither adopted nor deleted.
 	wgLinkExist, err := netlink.LinkByName(DeviceName)
 	if err == nil {
-		// delete existing device if not wireguard type.
+		if err := networkutil.EnsureLinkType(wgLinkExist, wgLinkType); err != nil {
+			return err
+		}
+		// recreate the wireguard device if its attributes changed.
 		if w.isWgDeviceChanged(wgLink, wgLinkExist) {
 			klog.InfoS("wireguard device changed", "link", wgLinkExist)
 			if err := netlink.LinkDel(wgLinkExist); err != nil {
@@ -223,6 +273,25 @@ func (w *wireguard) Apply(network *types.Network, routeDriverMTUFn func(*types.N
 		return w.Cleanup()
 	}
 
+	desiredAllowedIPs := make(map[string][]net.IPNet)
+	for name, newConn := range desiredConnections {
+		allowedIPs := parseSubnets(newConn.RemoteEndpoint.Subnets)
+		if newConn.RemoteEndpoint.NodeName == centralGw.NodeName {
+			allowedIPs = append(allowedIPs, parseSubnets(centralAllowedIPs)...)
+		}
+		desiredAllowedIPs[name] = allowedIPs
+	}
+	// WireGuard silently moves an allowed IP to the peer configured last, so peers with overlapping
+	// allowed IPs are removed, instead of routing the overlapping subnets to either of them.
+	conflicts, conflictErr := allowedIPsConflicts(desiredConnections, desiredAllowedIPs)
+	conflictingIPs := make([]net.IPNet, 0)
+	for name := range conflicts {
+		conflictingIPs = append(conflictingIPs, desiredAllowedIPs[name]...)
+	}
+	if conflictErr != nil {
+		w.recordConflicts(string(network.LocalEndpoint.GatewayName), conflictErr)
+	}
+
 	// 2. Ensure  WireGuard link
 	if err := w.ensureWgLink(network, routeDriverMTUFn); err != nil {
 		return fmt.Errorf("fail to ensure wireguar link: %v", err)
@@ -238,7 +307,7 @@ func (w *wireguard) Apply(network *types.Network, routeDriverMTUFn func(*types.N
 		return fmt.Errorf("error listing wireguard rules on node: %s", err)
 	}
 
-	desiredRoutes := w.calWgRoutes(network)
+	desiredRoutes := w.calWgRoutes(network, conflictingIPs)
 	desiredRules := w.calWgRules()
 
 	err = networkutil.ApplyRoutes(currentRoutes, desiredRoutes)
@@ -261,61 +330,195 @@ func (w *wireguard) Apply(network *types.Network, routeDriverMTUFn func(*types.N
 	}
 
 	// 5. add or update connections
-	peerConfigs := make([]wgtypes.PeerConfig, 0)
+	var currentPeers map[wgtypes.Key]*wgtypes.Peer
+	if d, err := w.wgClient.Device(DeviceName); err == nil {
+		currentPeers = make(map[wgtypes.Key]*wgtypes.Peer)
+		for i := range d.Peers {
+			currentPeers[d.Peers[i].PublicKey] = &d.Peers[i]
+		}
+	} else {
+		klog.ErrorS(err, "error getting wireguard peers, configuring all peers", "device", DeviceName)
+	}
 	for name, newConn := range desiredConnections {
-		newKey := keyFromEndpoint(newConn.RemoteEndpoint)
-
 		if oldConn, ok := w.connections[name]; ok {
 			oldKey := keyFromEndpoint(oldConn.RemoteEndpoint)
-			if oldKey.String() != newKey.String() {
+			if oldKey.String() != keyFromEndpoint(newConn.RemoteEndpoint).String() {
 				if err := w.removePeer(oldKey); err == nil {
 					delete(w.connections, name)
 				}
 			}
 		}
+	}
+	peerConfigs := w.peerConfigs(desiredConnections, desiredAllowedIPs, conflicts, currentPeers)
 
-		klog.InfoS("create connection", "c", newConn)
+	if len(peerConfigs) > 0 {
+		if err := w.wgClient.ConfigureDevice(DeviceName, wgtypes.Config{
+			ReplacePeers: false,
+			Peers:        peerConfigs,
+		}); err != nil {
+			return fmt.Errorf("error add peers: %v", err)
+		}
+	}
 
-		allowedIPs := parseSubnets(newConn.RemoteEndpoint.Subnets)
-		if newConn.RemoteEndpoint.NodeName == centralGw.NodeName {
-			allowedIPs = append(allowedIPs, parseSubnets(centralAllowedIPs)...)
+	for name := range conflicts {
+		delete(desiredConnections, name)
+	}
+	w.connections = desiredConnections
+
+	// The conflicts are not fixed by retrying until the gateways are changed.
+	return utils.NewPermanentError(conflictErr)
+}
+
+// peerConfigs returns the configs of the peers of conns that are not up-to-date on the device. The peers of the
+// conflicting connections are removed, since they may be configured before the conflict. currentPeers is nil if the
+// peers on the device are unknown, then all peers are configured.
+func (w *wireguard) peerConfigs(conns map[string]*vpndriver.Connection, allowedIPs map[string][]net.IPNet,
+	conflicts map[string]struct{}, currentPeers map[wgtypes.Key]*wgtypes.Peer) []wgtypes.PeerConfig {
+	peerConfigs := make([]wgtypes.PeerConfig, 0)
+	for name, conn := range conns {
+		key := keyFromEndpoint(conn.RemoteEndpoint)
+		if _, ok := conflicts[name]; ok {
+			if _, ok := currentPeers[*key]; ok || currentPeers == nil {
+				klog.InfoS("remove conflicting connection", "c", conn)
+				peerConfigs = append(peerConfigs, wgtypes.PeerConfig{PublicKey: *key, Remove: true})
+			}
+			continue
+		}
+		peer, changed := peerUpdate(currentPeers[*key], w.peerConfig(conn.RemoteEndpoint, allowedIPs[name]))
+		if !changed {
+			continue
+		}
+		if peer.UpdateOnly {
+			klog.InfoS("update connection endpoint", "c", conn, "endpoint", peer.Endpoint)
+		} else {
+			klog.InfoS("create connection", "c", conn)
 		}
+		peerConfigs = append(peerConfigs, peer)
+	}
+	return peerConfigs
+}
 
-		remotePort := ListenPort
-		ka := KeepAliveInterval
-		peerConfigs = append(peerConfigs, wgtypes.PeerConfig{
-			PublicKey:    *newKey,
-			Remove:       false,
-			UpdateOnly:   false,
-			PresharedKey: &w.psk,
-			Endpoint: &net.UDPAddr{
-				IP:   net.ParseIP(newConn.RemoteEndpoint.PublicIP),
-				Port: remotePort,
-			},
-			PersistentKeepaliveInterval: &ka,
-			ReplaceAllowedIPs:           true,
-			AllowedIPs:                  allowedIPs,
-		})
-	}
-
-	if err := w.wgClient.ConfigureDevice(DeviceName, wgtypes.Config{
-		ReplacePeers: false,
-		Peers:        peerConfigs,
-	}); err != nil {
-		return fmt.Errorf("error add peers: %v", err)
+// allowedIPsConflicts returns the connections whose allowed IPs overlap with another connection,
+// and an error describing each overlap.
+func allowedIPsConflicts(conns map[string]*vpndriver.Connection, allowedIPs map[string][]net.IPNet) (map[string]struct{}, error) {
+	names := make([]string, 0, len(conns))
+	for name := range conns {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	w.connections = desiredConnections
+	conflicts := make(map[string]struct{})
+	errList := errorlist.List{}
+	for i := range names {
+		for j := i + 1; j < len(names); j++ {
+			for _, a := range allowedIPs[names[i]] {
+				for _, b := range allowedIPs[names[j]] {
+					if !a.Contains(b.IP) && !b.Contains(a.IP) {
+						continue
+					}
+					conflicts[names[i]] = struct{}{}
+					conflicts[names[j]] = struct{}{}
+					errList = errList.Append(fmt.Errorf("allowed ip %s of gateway %s overlaps with %s of gateway %s",
+						a.String(), conns[names[i]].RemoteEndpoint.GatewayName, b.String(), conns[names[j]].RemoteEndpoint.GatewayName))
+				}
+			}
+		}
+	}
+	return conflicts, errList.AsError()
+}
 
-	return nil
+// recordConflicts emits the conflicts of allowed IPs on the local gateway, since no traffic to the conflicting
+// gateways goes through the WireGuard device until the gateways are changed.
+func (w *wireguard) recordConflicts(gwName string, conflictErr error) {
+	klog.ErrorS(conflictErr, "removing peers with conflicting allowed ips", "gateway", gwName)
+	var gw v1alpha1.Gateway
+	if err := w.ravenClient.Get(context.Background(), client.ObjectKey{Name: gwName}, &gw); err != nil {
+		klog.ErrorS(err, "error getting gateway to record conflicts", "gateway", gwName)
+		return
+	}
+	w.recorder.Eventf(&gw, corev1.EventTypeWarning, EventPeerConflict, "peers with conflicting allowed ips are removed: %v", conflictErr)
+}
+
+// peerConfig returns the WireGuard peer config of the given remote endpoint.
+func (w *wireguard) peerConfig(remote *types.Endpoint, allowedIPs []net.IPNet) wgtypes.PeerConfig {
+	remotePort := ListenPort
+	ka := w.keepAliveInterval
+	return wgtypes.PeerConfig{
+		PublicKey:    *keyFromEndpoint(remote),
+		Remove:       false,
+		UpdateOnly:   false,
+		PresharedKey: &w.psk,
+		Endpoint: &net.UDPAddr{
+			IP:   net.ParseIP(remote.PublicIP),
+			Port: remotePort,
+		},
+		PersistentKeepaliveInterval: &ka,
+		ReplaceAllowedIPs:           true,
+		AllowedIPs:                  allowedIPs,
+	}
+}
+
+// peerUpdate returns the config to bring the current peer to the desired one, and false if the peer is up to date.
+// If only the endpoint changed, e.g. the remote gateway roamed to another public IP, only the endpoint is updated,
+// and the allowed IPs are left untouched.
+func peerUpdate(current *wgtypes.Peer, desired wgtypes.PeerConfig) (wgtypes.PeerConfig, bool) {
+	if current == nil ||
+		current.PresharedKey != *desired.PresharedKey ||
+		current.PersistentKeepaliveInterval != *desired.PersistentKeepaliveInterval ||
+		!sameIPNets(current.AllowedIPs, desired.AllowedIPs) {
+		return desired, true
+	}
+	if current.Endpoint != nil && current.Endpoint.IP.Equal(desired.Endpoint.IP) && current.Endpoint.Port == desired.Endpoint.Port {
+		return wgtypes.PeerConfig{}, false
+	}
+	return wgtypes.PeerConfig{
+		PublicKey:  desired.PublicKey,
+		UpdateOnly: true,
+		Endpoint:   desired.Endpoint,
+	}, true
+}
+
+// sameIPNets reports whether a and b contain the same subnets regardless of order.
+func sameIPNets(a, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for i := range a {
+		count[a[i].String()]++
+	}
+	for i := range b {
+		count[b[i].String()]--
+	}
+	for _, c := range count {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
 }
 
+// MTU returns the MTU of the WireGuard device. The route driver takes the smaller one of its own MTU
+// and this MTU for the vxlan device, so an explicit MTU also applies to traffic routed into the tunnel.
 func (w *wireguard) MTU() (int, error) {
+	if w.mtu > 0 {
+		return w.mtu, nil
+	}
 	mtu, err := vpndriver.DefaultMTU()
 	if err != nil {
 		return 0, err
 	}
-	return mtu - wgEncapLen, nil
+	return mtu - w.Overhead(), nil
+}
+
+// Overhead returns the length of the WireGuard, UDP and outer IP headers, assuming a worst case IPv6 outer header.
+func (w *wireguard) Overhead() int {
+	return wgEncapLen
+}
+
+// Links returns the WireGuard device, whose statistics are exported as metrics.
+func (w *wireguard) Links() []string {
+	return []string{DeviceName}
 }
 
 func (w *wireguard) Cleanup() error {
@@ -324,7 +527,7 @@ func (w *wireguard) Cleanup() error {
 		errList = errList.Append(err)
 	}
 
-	if err := networkutil.CleanRoutesOnNode(wgRouteTableID); err != nil {
+	if err := networkutil.CleanRoutesOnNode(wgRouteTableID, w.routeProtocol); err != nil {
 		errList = errList.Append(err)
 	}
 
@@ -336,6 +539,10 @@ func (w *wireguard) Cleanup() error {
 		errList = errList.Append(fmt.Errorf("error retrieving the wireguard interface %q: %v", DeviceName, err))
 		return errList.AsError()
 	}
+	if err = networkutil.EnsureLinkType(link, wgLinkType); err != nil {
+		klog.ErrorS(err, "skip deleting link")
+		return errList.AsError()
+	}
 
 	if err = netlink.LinkDel(link); err != nil {
 		errList = errList.Append(fmt.Errorf("error delete existing wireguard device %q: %v", DeviceName, err))
@@ -393,7 +600,7 @@ func (w *wireguard) removePeer(key *wgtypes.Key) error {
 }
 
 func (w *wireguard) configGatewayPublicKey(gwName string, nodeName string) error {
-	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+	err := retry.RetryOnConflict(w.updateBackoff, func() error {
 		// get localGateway from api server
 		var apiGw v1alpha1.Gateway
 		err := w.ravenClient.Get(context.Background(), client.ObjectKey{
@@ -434,8 +641,12 @@ func (w *wireguard) calWgRules() map[string]*netlink.Rule {
 // The routes entries format are equivalent to the following `ip route` command:
 //
 //	ip route add {remote_subnet} dev raven-wg0 table {wgRouteTableID}
-func (w *wireguard) calWgRoutes(network *types.Network) map[string]*netlink.Route {
-	routes := make(map[string]*netlink.Route)
+//
+// The excluded destinations get throw routes, so that they are routed by the main table even if they are
+// in a remote subnet. The subnets overlapping with conflictingIPs are not routed, as the peers of the
+// conflicting allowed IPs are removed and the device would drop their traffic.
+func (w *wireguard) calWgRoutes(network *types.Network, conflictingIPs []net.IPNet) map[string]*netlink.Route {
+	routes := networkutil.ThrowRoutes(w.excludeCIDRs, wgRouteTableID, w.routeProtocol)
 	for _, v := range network.RemoteEndpoints {
 		for _, dstCIDR := range v.Subnets {
 			_, ipnet, err := net.ParseCIDR(dstCIDR)
@@ -443,11 +654,16 @@ func (w *wireguard) calWgRoutes(network *types.Network) map[string]*netlink.Rout
 				klog.ErrorS(err, "error parsing cidr", "cidr", dstCIDR)
 				continue
 			}
+			if overlaps(*ipnet, conflictingIPs) {
+				klog.InfoS("skipping route of conflicting allowed ips", "cidr", dstCIDR)
+				continue
+			}
 			nr := &netlink.Route{
 				LinkIndex: w.wgLink.Attrs().Index,
 				Scope:     netlink.SCOPE_LINK,
 				Dst:       ipnet,
 				Table:     wgRouteTableID,
+				Protocol:  w.routeProtocol,
 				MTU:       w.wgLink.Attrs().MTU,
 			}
 			routes[networkutil.RouteKey(nr)] = nr
@@ -456,6 +672,15 @@ func (w *wireguard) calWgRoutes(network *types.Network) map[string]*netlink.Rout
 	return routes
 }
 
+func overlaps(ipnet net.IPNet, nets []net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ipnet.IP) || ipnet.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
+
 func connectionName(localNodeName, remoteNodeName string) string {
 	return fmt.Sprintf("%s-%s", localNodeName, remoteNodeName)
 }
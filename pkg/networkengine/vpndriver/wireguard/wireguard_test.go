@@ -0,0 +1,395 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wireguard
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openyurtio/openyurt/pkg/apis/raven/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	networkutil "github.com/openyurtio/raven/pkg/networkengine/util"
+	"github.com/openyurtio/raven/pkg/networkengine/vpndriver"
+	"github.com/openyurtio/raven/pkg/types"
+)
+
+func TestWireguard_PeerConfig(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("error generating private key: %v", err)
+	}
+	remote := &types.Endpoint{
+		GatewayName: "remoteGw",
+		NodeName:    "remoteGwNode",
+		Subnets:     []string{"10.244.2.0/24"},
+		PrivateIP:   "192.168.0.2",
+		PublicIP:    "1.1.1.2",
+		Config: map[string]string{
+			PublicKey: key.PublicKey().String(),
+		},
+	}
+
+	testcases := []struct {
+		name              string
+		keepAliveInterval time.Duration
+	}{
+		{
+			name:              "default-keepalive",
+			keepAliveInterval: KeepAliveInterval,
+		},
+		{
+			name:              "custom-keepalive",
+			keepAliveInterval: 25 * time.Second,
+		},
+		{
+			name:              "keepalive-disabled",
+			keepAliveInterval: 0,
+		},
+	}
+
+	for _, v := range testcases {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			w := &wireguard{
+				keepAliveInterval: v.keepAliveInterval,
+			}
+			allowedIPs := parseSubnets(remote.Subnets)
+			peer := w.peerConfig(remote, allowedIPs)
+			a.Equal(key.PublicKey(), peer.PublicKey)
+			a.Equal("1.1.1.2", peer.Endpoint.IP.String())
+			a.Equal(ListenPort, peer.Endpoint.Port)
+			a.Equal(allowedIPs, peer.AllowedIPs)
+			if a.NotNil(peer.PersistentKeepaliveInterval) {
+				a.Equal(v.keepAliveInterval, *peer.PersistentKeepaliveInterval)
+			}
+		})
+	}
+}
+
+func TestWireguard_MTU(t *testing.T) {
+	w := &wireguard{
+		mtu: 1280,
+	}
+	mtu, err := w.MTU()
+	assert.Nil(t, err)
+	assert.Equal(t, 1280, mtu)
+}
+
+func TestWireguard_PeerUpdate(t *testing.T) {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("error generating private key: %v", err)
+	}
+	w := &wireguard{
+		keepAliveInterval: KeepAliveInterval,
+	}
+	newRemote := func(publicIP string, subnets ...string) *types.Endpoint {
+		return &types.Endpoint{
+			GatewayName: "remoteGw",
+			NodeName:    "remoteGwNode",
+			Subnets:     subnets,
+			PublicIP:    publicIP,
+			Config: map[string]string{
+				PublicKey: key.PublicKey().String(),
+			},
+		}
+	}
+	// currentPeer returns the peer on the device after the remote endpoint is fully configured.
+	currentPeer := func(remote *types.Endpoint) *wgtypes.Peer {
+		cfg := w.peerConfig(remote, parseSubnets(remote.Subnets))
+		return &wgtypes.Peer{
+			PublicKey:                   cfg.PublicKey,
+			PresharedKey:                *cfg.PresharedKey,
+			Endpoint:                    cfg.Endpoint,
+			PersistentKeepaliveInterval: *cfg.PersistentKeepaliveInterval,
+			AllowedIPs:                  cfg.AllowedIPs,
+		}
+	}
+
+	testcases := []struct {
+		name       string
+		current    *wgtypes.Peer
+		desired    *types.Endpoint
+		changed    bool
+		updateOnly bool
+	}{
+		{
+			name:    "new-peer",
+			desired: newRemote("1.1.1.2", "10.244.2.0/24"),
+			changed: true,
+		},
+		{
+			name:    "up-to-date",
+			current: currentPeer(newRemote("1.1.1.2", "10.244.2.0/24", "10.244.3.0/24")),
+			desired: newRemote("1.1.1.2", "10.244.3.0/24", "10.244.2.0/24"),
+		},
+		{
+			name:       "endpoint-only-changed",
+			current:    currentPeer(newRemote("1.1.1.2", "10.244.2.0/24")),
+			desired:    newRemote("1.1.1.3", "10.244.2.0/24"),
+			changed:    true,
+			updateOnly: true,
+		},
+		{
+			name:    "subnets-changed",
+			current: currentPeer(newRemote("1.1.1.2", "10.244.2.0/24")),
+			desired: newRemote("1.1.1.3", "10.244.4.0/24"),
+			changed: true,
+		},
+		{
+			name:    "subnet-added",
+			current: currentPeer(newRemote("1.1.1.2", "10.244.2.0/24")),
+			desired: newRemote("1.1.1.2", "10.244.2.0/24", "10.244.3.0/24"),
+			changed: true,
+		},
+		{
+			name:    "subnet-removed",
+			current: currentPeer(newRemote("1.1.1.2", "10.244.2.0/24", "10.244.3.0/24")),
+			desired: newRemote("1.1.1.2", "10.244.2.0/24"),
+			changed: true,
+		},
+	}
+
+	for _, v := range testcases {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			desired := w.peerConfig(v.desired, parseSubnets(v.desired.Subnets))
+			peer, changed := peerUpdate(v.current, desired)
+			a.Equal(v.changed, changed)
+			if !changed {
+				return
+			}
+			a.Equal(v.updateOnly, peer.UpdateOnly)
+			// the peer is updated in place, so that the session of unchanged subnets is kept.
+			a.False(peer.Remove)
+			a.Equal(key.PublicKey(), peer.PublicKey)
+			a.Equal(v.desired.PublicIP, peer.Endpoint.IP.String())
+			if v.updateOnly {
+				a.False(peer.ReplaceAllowedIPs, "allowed ips should be left untouched")
+				a.Empty(peer.AllowedIPs)
+			} else {
+				a.Equal(desired, peer)
+			}
+		})
+	}
+}
+
+func TestWireguard_Overhead(t *testing.T) {
+	// 40 bytes IPv6 header, 8 bytes UDP header and 32 bytes WireGuard header.
+	assert.Equal(t, 80, (&wireguard{}).Overhead())
+}
+
+func TestWireguard_CalWgRoutes(t *testing.T) {
+	a := assert.New(t)
+	excludeCIDRs, err := networkutil.ParseCIDRs([]string{"10.244.2.128/25"})
+	a.NoError(err)
+	w := &wireguard{
+		wgLink: &netlink.GenericLink{
+			LinkAttrs: netlink.LinkAttrs{Name: DeviceName, Index: 10, MTU: 1420},
+			LinkType:  "wireguard",
+		},
+		excludeCIDRs: excludeCIDRs,
+	}
+	network := &types.Network{
+		RemoteEndpoints: map[types.GatewayName]*types.Endpoint{
+			"remoteGw": {
+				GatewayName: "remoteGw",
+				Subnets:     []string{"10.244.2.0/24"},
+			},
+		},
+	}
+
+	routes := w.calWgRoutes(network, nil)
+	a.Len(routes, 2)
+	for _, route := range routes {
+		a.Equal(wgRouteTableID, route.Table)
+		switch route.Dst.String() {
+		case "10.244.2.0/24":
+			a.Equal(10, route.LinkIndex)
+			a.Equal(1420, route.MTU)
+		case "10.244.2.128/25":
+			// the excluded destination is thrown back to the main table.
+			a.Equal(unix.RTN_THROW, route.Type)
+			a.Zero(route.LinkIndex)
+		default:
+			t.Errorf("unexpected route %s", route.Dst)
+		}
+	}
+}
+
+func TestWireguard_CalWgRoutesConflicts(t *testing.T) {
+	a := assert.New(t)
+	w := &wireguard{
+		wgLink: &netlink.GenericLink{
+			LinkAttrs: netlink.LinkAttrs{Name: DeviceName, Index: 10, MTU: 1420},
+			LinkType:  "wireguard",
+		},
+	}
+	conns := map[string]*vpndriver.Connection{
+		"gw1": {RemoteEndpoint: &types.Endpoint{GatewayName: "gw1", Subnets: []string{"10.244.0.0/16"}}},
+		"gw2": {RemoteEndpoint: &types.Endpoint{GatewayName: "gw2", Subnets: []string{"10.244.2.0/24", "10.246.0.0/24"}}},
+		"gw3": {RemoteEndpoint: &types.Endpoint{GatewayName: "gw3", Subnets: []string{"10.245.0.0/24"}}},
+	}
+	network := &types.Network{RemoteEndpoints: make(map[types.GatewayName]*types.Endpoint)}
+	allowedIPs := make(map[string][]net.IPNet)
+	for name, conn := range conns {
+		network.RemoteEndpoints[conn.RemoteEndpoint.GatewayName] = conn.RemoteEndpoint
+		allowedIPs[name] = parseSubnets(conn.RemoteEndpoint.Subnets)
+	}
+	conflicts, err := allowedIPsConflicts(conns, allowedIPs)
+	a.Error(err)
+	conflictingIPs := make([]net.IPNet, 0)
+	for name := range conflicts {
+		conflictingIPs = append(conflictingIPs, allowedIPs[name]...)
+	}
+
+	// the peers of gw1 and gw2 are removed, so none of their subnets is routed to the device.
+	routes := w.calWgRoutes(network, conflictingIPs)
+	dsts := make([]string, 0, len(routes))
+	for _, route := range routes {
+		dsts = append(dsts, route.Dst.String())
+	}
+	a.Equal([]string{"10.245.0.0/24"}, dsts)
+}
+
+func TestWireguard_RecordConflicts(t *testing.T) {
+	a := assert.New(t)
+	scheme := runtime.NewScheme()
+	a.NoError(v1alpha1.AddToScheme(scheme))
+	recorder := record.NewFakeRecorder(1)
+	w := &wireguard{
+		ravenClient: fake.NewClientBuilder().WithScheme(scheme).
+			WithObjects(&v1alpha1.Gateway{ObjectMeta: metav1.ObjectMeta{Name: "localGw"}}).Build(),
+		recorder: recorder,
+	}
+	w.recordConflicts("localGw", errors.New("allowed ip 10.244.0.0/16 of gateway gw1 overlaps with 10.244.2.0/24 of gateway gw2"))
+	a.Len(recorder.Events, 1)
+	event := <-recorder.Events
+	a.Contains(event, "Warning "+EventPeerConflict)
+	a.Contains(event, "gateway gw1 overlaps")
+}
+
+func TestAllowedIPsConflicts(t *testing.T) {
+	conn := func(gw string) *vpndriver.Connection {
+		return &vpndriver.Connection{RemoteEndpoint: &types.Endpoint{GatewayName: types.GatewayName(gw)}}
+	}
+	conns := map[string]*vpndriver.Connection{
+		"gw1": conn("gw1"),
+		"gw2": conn("gw2"),
+		"gw3": conn("gw3"),
+	}
+
+	t.Run("no-overlap", func(t *testing.T) {
+		a := assert.New(t)
+		conflicts, err := allowedIPsConflicts(conns, map[string][]net.IPNet{
+			"gw1": parseSubnets([]string{"10.244.1.0/24"}),
+			"gw2": parseSubnets([]string{"10.244.2.0/24"}),
+			"gw3": parseSubnets([]string{"10.244.3.0/24", "10.244.4.0/24"}),
+		})
+		a.NoError(err)
+		a.Empty(conflicts)
+	})
+
+	t.Run("overlap", func(t *testing.T) {
+		a := assert.New(t)
+		conflicts, err := allowedIPsConflicts(conns, map[string][]net.IPNet{
+			"gw1": parseSubnets([]string{"10.244.0.0/16"}),
+			"gw2": parseSubnets([]string{"10.244.2.0/24"}),
+			"gw3": parseSubnets([]string{"10.245.0.0/24"}),
+		})
+		a.Error(err)
+		a.Contains(err.Error(), "allowed ip 10.244.0.0/16 of gateway gw1 overlaps with 10.244.2.0/24 of gateway gw2")
+		a.Equal(map[string]struct{}{"gw1": {}, "gw2": {}}, conflicts, "only the overlapping peers should be skipped")
+	})
+}
+
+func TestWireguard_PeerConfigsConflicts(t *testing.T) {
+	w := &wireguard{
+		keepAliveInterval: KeepAliveInterval,
+	}
+	conns := make(map[string]*vpndriver.Connection)
+	keys := make(map[string]wgtypes.Key)
+	for _, gw := range []string{"gw1", "gw2", "gw3"} {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("error generating private key: %v", err)
+		}
+		keys[gw] = key.PublicKey()
+		conns[gw] = &vpndriver.Connection{RemoteEndpoint: &types.Endpoint{
+			GatewayName: types.GatewayName(gw),
+			PublicIP:    "1.1.1.2",
+			Config:      map[string]string{PublicKey: key.PublicKey().String()},
+		}}
+	}
+	// gw2 starts overlapping with gw1, which is configured before the conflict.
+	allowedIPs := map[string][]net.IPNet{
+		"gw1": parseSubnets([]string{"10.244.1.0/24"}),
+		"gw2": parseSubnets([]string{"10.244.0.0/16"}),
+		"gw3": parseSubnets([]string{"10.245.0.0/24"}),
+	}
+	conflicts, err := allowedIPsConflicts(conns, allowedIPs)
+	if err == nil {
+		t.Fatal("allowed ips should conflict")
+	}
+
+	testcases := []struct {
+		name         string
+		currentPeers map[wgtypes.Key]*wgtypes.Peer
+		removed      []wgtypes.Key
+	}{
+		{
+			name:         "conflicting-peer-configured",
+			currentPeers: map[wgtypes.Key]*wgtypes.Peer{keys["gw1"]: {PublicKey: keys["gw1"]}},
+			removed:      []wgtypes.Key{keys["gw1"]},
+		},
+		{
+			name:         "conflicting-peers-not-configured",
+			currentPeers: map[wgtypes.Key]*wgtypes.Peer{},
+		},
+		{
+			name:    "current-peers-unknown",
+			removed: []wgtypes.Key{keys["gw1"], keys["gw2"]},
+		},
+	}
+
+	for _, v := range testcases {
+		t.Run(v.name, func(t *testing.T) {
+			a := assert.New(t)
+			var removed []wgtypes.Key
+			var configured []wgtypes.Key
+			for _, peer := range w.peerConfigs(conns, allowedIPs, conflicts, v.currentPeers) {
+				if peer.Remove {
+					removed = append(removed, peer.PublicKey)
+				} else {
+					configured = append(configured, peer.PublicKey)
+				}
+			}
+			a.ElementsMatch(v.removed, removed)
+			a.Equal([]wgtypes.Key{keys["gw3"]}, configured, "only the peer without conflicts should be configured")
+		})
+	}
+}
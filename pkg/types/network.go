@@ -37,6 +37,8 @@ type Endpoint struct {
 	PublicIP  string
 	UnderNAT  bool
 	Config    map[string]string
+	// Relay indicates the gateway is preferred as the central gateway relaying traffic between NATed gateways.
+	Relay bool
 }
 
 func (e *Endpoint) String() string {
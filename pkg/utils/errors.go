@@ -0,0 +1,67 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"errors"
+
+	"github.com/vdobler/ht/errorlist"
+)
+
+// PermanentError is an error that is not fixed by retrying, e.g. conflicting configuration of gateways.
+// A sync failed with it is not retried until the next Gateway event or resync.
+type PermanentError struct {
+	Err error
+}
+
+// NewPermanentError marks err as permanent, nil if err is nil.
+func NewPermanentError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// IsPermanentError returns whether err is a PermanentError, or an errorlist.List of only PermanentErrors,
+// so that an aggregated error is retried if any of its errors is transient.
+func IsPermanentError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var permanentErr *PermanentError
+	if errors.As(err, &permanentErr) {
+		return true
+	}
+	var list errorlist.List
+	if !errors.As(err, &list) || len(list) == 0 {
+		return false
+	}
+	for _, e := range list {
+		if !IsPermanentError(e) {
+			return false
+		}
+	}
+	return true
+}
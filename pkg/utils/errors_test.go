@@ -0,0 +1,58 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/vdobler/ht/errorlist"
+)
+
+func TestIsPermanentError(t *testing.T) {
+	transient := errors.New("connection refused")
+	permanent := NewPermanentError(errors.New("overlapping subnets"))
+	tests := []struct {
+		name   string
+		err    error
+		expect bool
+	}{
+		{name: "nil", err: nil, expect: false},
+		{name: "transient", err: transient, expect: false},
+		{name: "permanent", err: permanent, expect: true},
+		{name: "wrapped-permanent", err: fmt.Errorf("error applying network: %w", permanent), expect: true},
+		{name: "all-permanent-list", err: errorlist.List{}.Append(permanent).Append(NewPermanentError(transient)), expect: true},
+		{name: "mixed-list", err: errorlist.List{}.Append(permanent).Append(transient), expect: false},
+		{name: "wrapped-mixed-list", err: fmt.Errorf("error applying network: %w", errorlist.List{}.Append(transient).Append(permanent)), expect: false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			t.Logf("\tTestCase: %s", tt.name)
+
+			get := IsPermanentError(tt.err)
+
+			if get != tt.expect {
+				t.Fatalf("\t%s\texpect %v, but get %v", failed, tt.expect, get)
+			}
+			t.Logf("\t%s\texpect %v, get %v", succeed, tt.expect, get)
+		})
+	}
+}
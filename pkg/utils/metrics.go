@@ -0,0 +1,62 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	resultSuccess = "success"
+	resultError   = "error"
+)
+
+var (
+	publicIPRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "raven_public_ip_requests_total",
+		Help: "Total number of requests to public IP APIs, partitioned by api and result.",
+	}, []string{"api", "result"})
+
+	publicIPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "raven_public_ip_request_duration_seconds",
+		Help:    "Duration of requests to public IP APIs, partitioned by api.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"api"})
+
+	publicIPLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "raven_public_ip_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful public IP detection.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(publicIPRequestsTotal, publicIPRequestDuration, publicIPLastSuccess)
+}
+
+// observePublicIPRequest records the result and duration of a request to a public IP API.
+func observePublicIPRequest(api string, start time.Time, err error) {
+	publicIPRequestDuration.WithLabelValues(api).Observe(time.Since(start).Seconds())
+	if err != nil {
+		publicIPRequestsTotal.WithLabelValues(api, resultError).Inc()
+		return
+	}
+	publicIPRequestsTotal.WithLabelValues(api, resultSuccess).Inc()
+	publicIPLastSuccess.SetToCurrentTime()
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2022 The OpenYurt Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+func TestPublicIPRequestMetrics(t *testing.T) {
+	api := "http://metrics-test-api"
+	r := newFakeResolver(PublicIPConfig{APIs: []string{api}}, func(ctx context.Context, api string) (string, error) {
+		return "", errors.New("api is down")
+	})
+
+	_, err := r.ForceRefreshPublicIP(context.Background())
+	if err == nil {
+		t.Fatalf("\t%s\texpect error, but get nil", failed)
+	}
+
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("\t%s\terror gathering metrics: %v", failed, err)
+	}
+	var get float64
+	for _, f := range families {
+		if f.GetName() != "raven_public_ip_requests_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["api"] == api && labels["result"] == resultError {
+				get = m.GetCounter().GetValue()
+			}
+		}
+	}
+	if get != 1 {
+		t.Fatalf("\t%s\texpect 1 failed request, but get %v", failed, get)
+	}
+	t.Logf("\t%s\texpect 1 failed request, get %v", succeed, get)
+}
@@ -17,13 +17,21 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sync"
+	"time"
+
+	"github.com/vdobler/ht/errorlist"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 var (
+	// APIs is the default list of public IP APIs, used when no APIs are configured.
 	APIs = [...]string{
 		"https://api.ipify.org",
 		"https://api.my-ip.io/ip",
@@ -31,20 +39,249 @@ var (
 	}
 )
 
+const (
+	// DefaultPublicIPCacheTTL is how long a detected public IP is reused before the APIs are queried again.
+	DefaultPublicIPCacheTTL = 5 * time.Minute
+	// DefaultPublicIPAPITimeout is the timeout of querying a single public IP API.
+	DefaultPublicIPAPITimeout = 5 * time.Second
+
+	// maxConcurrentAPIQueries limits the number of public IP APIs queried at the same time.
+	maxConcurrentAPIQueries = 4
+
+	// An API failed recently is skipped for a backoff period, which starts from apiBackoffBase and
+	// doubles on each consecutive failure, up to apiBackoffMax. A jitter of up to apiBackoffJitter*backoff is added.
+	apiBackoffBase   = 10 * time.Second
+	apiBackoffMax    = 5 * time.Minute
+	apiBackoffJitter = 0.5
+)
+
 var IPv4RE = regexp.MustCompile(`(?:\d{1,3}\.){3}\d{1,3}`)
 
-func GetPublicIP() (string, error) {
-	for _, api := range APIs {
-		ip, err := getFromAPI(api)
-		if err == nil {
-			return ip, nil
+// PublicIPResolver detects the public IP of the current node.
+type PublicIPResolver interface {
+	// GetPublicIP returns the cached public IP if it is still fresh, otherwise detects it again.
+	GetPublicIP(ctx context.Context) (string, error)
+	// ForceRefreshPublicIP always detects the public IP and refreshes the cache.
+	ForceRefreshPublicIP(ctx context.Context) (string, error)
+}
+
+// PublicIPConfig is the configuration of a PublicIPResolver.
+type PublicIPConfig struct {
+	// APIs is the list of public IP APIs. The default APIs are used if it is empty.
+	APIs []string
+	// CacheTTL is how long a detected public IP is cached. A non-positive CacheTTL disables the cache.
+	CacheTTL time.Duration
+	// Timeout is the timeout of querying a single API. DefaultPublicIPAPITimeout is used if it is not positive.
+	Timeout time.Duration
+	// Override is the public IP returned as is without querying the APIs, e.g. the IP of a static load balancer.
+	Override string
+}
+
+type publicIPResolver struct {
+	apis     []string
+	cacheTTL time.Duration
+	timeout  time.Duration
+	// can be modified for testing.
+	getFromAPI func(ctx context.Context, api string) (string, error)
+
+	mu      sync.Mutex
+	ip      string
+	expires time.Time
+	// backoffs tracks recently failed APIs, indexed by API.
+	backoffs map[string]*apiBackoff
+}
+
+type apiBackoff struct {
+	failures   int
+	retryAfter time.Time
+}
+
+// staticPublicIP is a PublicIPResolver always returning the configured public IP.
+type staticPublicIP string
+
+var (
+	_ PublicIPResolver = (*publicIPResolver)(nil)
+	_ PublicIPResolver = staticPublicIP("")
+)
+
+// NewPublicIPResolver returns a PublicIPResolver with the given configuration.
+func NewPublicIPResolver(cfg PublicIPConfig) PublicIPResolver {
+	if cfg.Override != "" {
+		return staticPublicIP(cfg.Override)
+	}
+	return newPublicIPResolver(cfg)
+}
+
+func (s staticPublicIP) GetPublicIP(_ context.Context) (string, error) {
+	return string(s), nil
+}
+
+func (s staticPublicIP) ForceRefreshPublicIP(_ context.Context) (string, error) {
+	return string(s), nil
+}
+
+func newPublicIPResolver(cfg PublicIPConfig) *publicIPResolver {
+	r := &publicIPResolver{
+		apis:       cfg.APIs,
+		cacheTTL:   cfg.CacheTTL,
+		timeout:    cfg.Timeout,
+		getFromAPI: getFromAPI,
+		backoffs:   make(map[string]*apiBackoff),
+	}
+	if len(r.apis) == 0 {
+		r.apis = APIs[:]
+	}
+	if r.timeout <= 0 {
+		r.timeout = DefaultPublicIPAPITimeout
+	}
+	return r
+}
+
+func (r *publicIPResolver) GetPublicIP(ctx context.Context) (string, error) {
+	if ip, ok := r.cached(); ok {
+		return ip, nil
+	}
+	return r.ForceRefreshPublicIP(ctx)
+}
+
+// ForceRefreshPublicIP queries the APIs concurrently, each with the configured timeout,
+// and returns the first successful result. ctx.Err() is returned as soon as ctx is done.
+func (r *publicIPResolver) ForceRefreshPublicIP(ctx context.Context) (string, error) {
+	ip, err := r.queryAPIs(ctx)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ip = ip
+	r.expires = time.Now().Add(r.cacheTTL)
+	return ip, nil
+}
+
+func (r *publicIPResolver) cached() (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cacheTTL <= 0 || r.ip == "" || time.Now().After(r.expires) {
+		return "", false
+	}
+	return r.ip, true
+}
+
+// availableAPIs returns the APIs that are not backing off.
+func (r *publicIPResolver) availableAPIs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	apis := make([]string, 0, len(r.apis))
+	for _, api := range r.apis {
+		if b, ok := r.backoffs[api]; ok && now.Before(b.retryAfter) {
+			continue
 		}
+		apis = append(apis, api)
+	}
+	return apis
+}
+
+// recordResult resets the backoff of api on success, and extends it on failure.
+func (r *publicIPResolver) recordResult(api string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		delete(r.backoffs, api)
+		return
 	}
-	return "", fmt.Errorf("error get public ip by any of the apis: %v", APIs)
+	b, ok := r.backoffs[api]
+	if !ok {
+		b = &apiBackoff{}
+		r.backoffs[api] = b
+	}
+	b.failures++
+	backoff := apiBackoffMax
+	if b.failures < 16 {
+		backoff = apiBackoffBase << (b.failures - 1)
+	}
+	if backoff > apiBackoffMax {
+		backoff = apiBackoffMax
+	}
+	b.retryAfter = time.Now().Add(wait.Jitter(backoff, apiBackoffJitter))
 }
 
-func getFromAPI(api string) (string, error) {
-	resp, err := http.Get(api)
+// queryAPIs queries at most maxConcurrentAPIQueries apis at the same time and returns the first IP found.
+// The remaining queries are cancelled once an IP is found. APIs that are backing off are skipped.
+func (r *publicIPResolver) queryAPIs(ctx context.Context) (string, error) {
+	apis := r.availableAPIs()
+	if len(apis) == 0 {
+		return "", fmt.Errorf("error get public ip: all of the apis %v failed recently and are backing off", r.apis)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		ip  string
+		err error
+	}
+	// Every api sends exactly one result, so the buffer ensures no goroutine is blocked after returning.
+	results := make(chan result, len(apis))
+	go func() {
+		sem := make(chan struct{}, maxConcurrentAPIQueries)
+		for _, api := range apis {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results <- result{err: ctx.Err()}
+				continue
+			}
+			go func(api string) {
+				defer func() { <-sem }()
+				apiCtx, apiCancel := context.WithTimeout(ctx, r.timeout)
+				defer apiCancel()
+				start := time.Now()
+				ip, err := r.getFromAPI(apiCtx, api)
+				observePublicIPRequest(api, start, err)
+				// Cancelled by the first success or the caller, which says nothing about the api.
+				if err == nil || ctx.Err() == nil {
+					r.recordResult(api, err)
+				}
+				results <- result{ip: ip, err: err}
+			}(api)
+		}
+	}()
+
+	errList := errorlist.List{}
+	for range apis {
+		select {
+		case res := <-results:
+			if res.err == nil {
+				return res.ip, nil
+			}
+			errList = errList.Append(res.err)
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	return "", fmt.Errorf("error get public ip by any of the apis %v: %v", apis, errList.AsError())
+}
+
+// ValidatePublicIPAPIs checks that each api is an absolute http or https URL.
+func ValidatePublicIPAPIs(apis []string) error {
+	for _, api := range apis {
+		u, err := url.Parse(api)
+		if err != nil {
+			return fmt.Errorf("invalid public ip api %q: %v", api, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid public ip api %q: must be an http or https URL", api)
+		}
+	}
+	return nil
+}
+
+func getFromAPI(ctx context.Context, api string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
+	if err != nil {
+		return "", fmt.Errorf("creating request to %s: %v", api, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("retrieving public ip from %s: %v", api, err)
 	}
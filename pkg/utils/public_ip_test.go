@@ -17,8 +17,14 @@
 package utils
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const (
@@ -27,7 +33,7 @@ const (
 )
 
 func TestGetPublicIP(t *testing.T) {
-	res, _ := getFromAPI(APIs[0])
+	res, _ := getFromAPI(context.Background(), APIs[0])
 
 	tests := []struct {
 		name   string
@@ -45,7 +51,7 @@ func TestGetPublicIP(t *testing.T) {
 			t.Parallel()
 			t.Logf("\tTestCase: %s", tt.name)
 
-			get, _ := GetPublicIP()
+			get, _ := NewPublicIPResolver(PublicIPConfig{}).GetPublicIP(context.Background())
 
 			if !reflect.DeepEqual(get, tt.expect) {
 				t.Fatalf("\t%s\texpect %v, but get %v", failed, tt.expect, get)
@@ -54,3 +60,277 @@ func TestGetPublicIP(t *testing.T) {
 		})
 	}
 }
+
+func TestGetPublicIPFromAPIs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("1.2.3.4\n"))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		apis      []string
+		expect    string
+		expectErr bool
+	}{
+		{
+			name:   "local-api",
+			apis:   []string{srv.URL},
+			expect: "1.2.3.4",
+		},
+		{
+			name:   "fallback-to-next-api",
+			apis:   []string{"http://127.0.0.1:1", srv.URL},
+			expect: "1.2.3.4",
+		},
+		{
+			name:      "all-apis-failed",
+			apis:      []string{"http://127.0.0.1:1"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Logf("\tTestCase: %s", tt.name)
+
+			get, err := NewPublicIPResolver(PublicIPConfig{APIs: tt.apis}).GetPublicIP(context.Background())
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("\t%s\texpect error %v, but get %v", failed, tt.expectErr, err)
+			}
+			if get != tt.expect {
+				t.Fatalf("\t%s\texpect %v, but get %v", failed, tt.expect, get)
+			}
+			t.Logf("\t%s\texpect %v, get %v", succeed, tt.expect, get)
+		})
+	}
+}
+
+func TestValidatePublicIPAPIs(t *testing.T) {
+	tests := []struct {
+		name      string
+		apis      []string
+		expectErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "valid",
+			apis: []string{"https://api.ipify.org", "http://10.0.0.1:8080/ip"},
+		},
+		{
+			name:      "missing-scheme",
+			apis:      []string{"api.ipify.org"},
+			expectErr: true,
+		},
+		{
+			name:      "unsupported-scheme",
+			apis:      []string{"ftp://api.ipify.org"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			t.Logf("\tTestCase: %s", tt.name)
+
+			err := ValidatePublicIPAPIs(tt.apis)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("\t%s\texpect error %v, but get %v", failed, tt.expectErr, err)
+			}
+			t.Logf("\t%s\texpect error %v, get %v", succeed, tt.expectErr, err)
+		})
+	}
+}
+
+func newFakeResolver(cfg PublicIPConfig, fn func(ctx context.Context, api string) (string, error)) *publicIPResolver {
+	r := newPublicIPResolver(cfg)
+	r.getFromAPI = fn
+	return r
+}
+
+func TestPublicIPResolverCache(t *testing.T) {
+	tests := []struct {
+		name        string
+		ttl         time.Duration
+		force       bool
+		expectCalls int
+	}{
+		{
+			name:        "cached-within-ttl",
+			ttl:         time.Minute,
+			expectCalls: 1,
+		},
+		{
+			name:        "force-refresh",
+			ttl:         time.Minute,
+			force:       true,
+			expectCalls: 2,
+		},
+		{
+			name:        "cache-disabled",
+			ttl:         0,
+			expectCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			t.Logf("\tTestCase: %s", tt.name)
+			var calls int32
+			r := newFakeResolver(PublicIPConfig{APIs: []string{"http://fake-api"}, CacheTTL: tt.ttl},
+				func(ctx context.Context, api string) (string, error) {
+					atomic.AddInt32(&calls, 1)
+					return "1.2.3.4", nil
+				})
+
+			for i := 0; i < 2; i++ {
+				var err error
+				if tt.force {
+					_, err = r.ForceRefreshPublicIP(context.Background())
+				} else {
+					_, err = r.GetPublicIP(context.Background())
+				}
+				if err != nil {
+					t.Fatalf("\t%s\tunexpected error: %v", failed, err)
+				}
+			}
+			if get := int(atomic.LoadInt32(&calls)); get != tt.expectCalls {
+				t.Fatalf("\t%s\texpect %v calls, but get %v", failed, tt.expectCalls, get)
+			}
+			t.Logf("\t%s\texpect %v calls", succeed, tt.expectCalls)
+		})
+	}
+}
+
+func TestPublicIPResolverCancel(t *testing.T) {
+	r := newFakeResolver(PublicIPConfig{APIs: []string{"http://fake-api-1", "http://fake-api-2"}},
+		func(ctx context.Context, api string) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := r.ForceRefreshPublicIP(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("\t%s\texpect %v, but get %v", failed, context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > DefaultPublicIPAPITimeout {
+		t.Fatalf("\t%s\texpect to return promptly, but take %v", failed, elapsed)
+	}
+	t.Logf("\t%s\texpect %v, get %v", succeed, context.DeadlineExceeded, err)
+}
+
+func TestPublicIPResolverFirstSuccess(t *testing.T) {
+	fn := func(ctx context.Context, api string) (string, error) {
+		switch api {
+		case "http://slow-api":
+			// blocks until cancelled by the first success.
+			<-ctx.Done()
+			return "", ctx.Err()
+		case "http://fast-api":
+			return "1.2.3.4", nil
+		default:
+			return "", fmt.Errorf("api %s is down", api)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		apis      []string
+		expect    string
+		expectErr bool
+	}{
+		{
+			name:   "slow-api-first",
+			apis:   []string{"http://slow-api", "http://down-api", "http://fast-api"},
+			expect: "1.2.3.4",
+		},
+		{
+			name:   "more-apis-than-concurrency",
+			apis:   []string{"http://down-api", "http://down-api", "http://down-api", "http://down-api", "http://fast-api"},
+			expect: "1.2.3.4",
+		},
+		{
+			name:      "all-apis-failed",
+			apis:      []string{"http://down-api-1", "http://down-api-2"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			t.Logf("\tTestCase: %s", tt.name)
+
+			get, err := newFakeResolver(PublicIPConfig{APIs: tt.apis}, fn).GetPublicIP(context.Background())
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("\t%s\texpect error %v, but get %v", failed, tt.expectErr, err)
+			}
+			if get != tt.expect {
+				t.Fatalf("\t%s\texpect %v, but get %v", failed, tt.expect, get)
+			}
+			t.Logf("\t%s\texpect %v, get %v", succeed, tt.expect, get)
+		})
+	}
+}
+
+func TestPublicIPResolverBackoff(t *testing.T) {
+	var down int32 = 1
+	var calls int32
+	r := newFakeResolver(PublicIPConfig{APIs: []string{"http://flaky-api"}},
+		func(ctx context.Context, api string) (string, error) {
+			atomic.AddInt32(&calls, 1)
+			if atomic.LoadInt32(&down) == 1 {
+				return "", fmt.Errorf("api %s is down", api)
+			}
+			return "1.2.3.4", nil
+		})
+
+	// The first failure puts the api into backoff, so the second query does not touch it.
+	for i := 0; i < 2; i++ {
+		if _, err := r.ForceRefreshPublicIP(context.Background()); err == nil {
+			t.Fatalf("\t%s\texpect error, but get nil", failed)
+		}
+	}
+	if get := atomic.LoadInt32(&calls); get != 1 {
+		t.Fatalf("\t%s\texpect 1 call while backing off, but get %v", failed, get)
+	}
+
+	// The api is retried once the backoff elapsed, and success resets the backoff.
+	atomic.StoreInt32(&down, 0)
+	r.mu.Lock()
+	r.backoffs["http://flaky-api"].retryAfter = time.Now()
+	r.mu.Unlock()
+	if ip, err := r.ForceRefreshPublicIP(context.Background()); err != nil || ip != "1.2.3.4" {
+		t.Fatalf("\t%s\texpect 1.2.3.4, but get %v, %v", failed, ip, err)
+	}
+	if len(r.availableAPIs()) != 1 {
+		t.Fatalf("\t%s\texpect backoff to be reset after success", failed)
+	}
+	t.Logf("\t%s\tbackoff skips failed api and resets on success", succeed)
+}
+
+func TestPublicIPResolverOverride(t *testing.T) {
+	expect := "203.0.113.10"
+	r := NewPublicIPResolver(PublicIPConfig{
+		APIs:     []string{"http://fake-api-1"},
+		Override: expect,
+	})
+	for _, get := range []func(context.Context) (string, error){r.GetPublicIP, r.ForceRefreshPublicIP} {
+		ip, err := get(context.Background())
+		if err != nil || ip != expect {
+			t.Fatalf("\t%s\texpect %v, but get %v, %v", failed, expect, ip, err)
+		}
+	}
+	t.Logf("\t%s\texpect %v without querying the apis", succeed, expect)
+}